@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 
+	"github.com/fnmzgdt/e_shop/src/migrations"
+	"github.com/fnmzgdt/e_shop/src/repositories"
 	"github.com/fnmzgdt/e_shop/src/router"
+	"github.com/fnmzgdt/e_shop/src/utils"
 	"github.com/joho/godotenv"
 )
 
@@ -12,5 +17,24 @@ func main() {
 	if err != nil {
 		fmt.Println(err)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
 	router.StartServer()
 }
+
+func migrate(args []string) {
+	setup := repositories.SetupMySQLMigrator
+	if utils.GetEnv("DB_DRIVER", "mysql") == "sqlite" {
+		setup = repositories.SetupSQLiteMigrator
+	}
+	migrator, err := setup()
+	if err == nil {
+		err = migrations.Command(context.Background(), migrator, args, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package apperrors
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Check for the kinds with errors.Is, e.g. errors.Is(err, apperrors.ErrNotFound); the responses package maps each kind to its HTTP status.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrValidation         = errors.New("validation failed")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+//The Code is stable for clients to branch on and the Message is safe to show them; the underlying Err is only logged.
+type Error struct {
+	Kind    error
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+type FieldError struct {
+	Field   string                 `json:"field,omitempty"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func New(kind error, code string, message string, err error) error {
+	return &Error{Kind: kind, Code: code, Message: message, Err: err}
+}
+
+func NotFound(code string, message string) error {
+	return New(ErrNotFound, code, message, nil)
+}
+
+func Conflict(code string, message string) error {
+	return New(ErrConflict, code, message, nil)
+}
+
+func Validation(code string, message string) error {
+	return New(ErrValidation, code, message, nil)
+}
+
+func Unauthorized(code string, message string) error {
+	return New(ErrUnauthorized, code, message, nil)
+}
+
+func Forbidden(code string, message string) error {
+	return New(ErrForbidden, code, message, nil)
+}
+
+func PreconditionFailed(code string, message string) error {
+	return New(ErrPreconditionFailed, code, message, nil)
+}
+
+type Violations struct {
+	fields []FieldError
+}
+
+func (v *Violations) Add(field string, code string, message string) {
+	v.AddParams(field, code, message, nil)
+}
+
+func (v *Violations) AddParams(field string, code string, message string, params map[string]interface{}) {
+	v.fields = append(v.fields, FieldError{Field: field, Code: code, Message: message, Params: params})
+}
+
+func (v *Violations) Merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	var domainError *Error
+	if !errors.As(err, &domainError) || len(domainError.Fields) == 0 {
+		v.Add(prefix, "invalid", err.Error())
+		return
+	}
+	for _, field := range domainError.Fields {
+		path := prefix
+		switch {
+		case field.Field == "":
+		case path == "" || strings.HasPrefix(field.Field, "["):
+			path += field.Field
+		default:
+			path += "." + field.Field
+		}
+		v.AddParams(path, field.Code, field.Message, field.Params)
+	}
+}
+
+func (v *Violations) Err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("The request has %d invalid fields.", len(v.fields))
+	if len(v.fields) == 1 {
+		message = v.fields[0].Message
+	}
+	return &Error{Kind: ErrValidation, Code: "validation_failed", Message: message, Fields: v.fields}
+}
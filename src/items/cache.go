@@ -0,0 +1,283 @@
+package items
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+type Cache interface {
+	GetKey(ctx context.Context, key string) (string, error)
+	SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error
+	DeleteKeys(ctx context.Context, keys ...string) (int64, error)
+	AddToSet(ctx context.Context, key string, exp time.Duration, members ...interface{}) error
+	GetSetMembers(ctx context.Context, key string) ([]string, error)
+}
+
+//The cache metrics are published with the other expvars on /debug/vars.
+var cacheMetrics = expvar.NewMap("items_cache")
+
+//The two sets index the cached keys so they can be invalidated together.
+const (
+	itemCacheKey   = "items:item:%d"
+	listCacheKey   = "items:list:%d"
+	itemsCacheKeys = "items:cache:items"
+	listsCacheKeys = "items:cache:lists"
+)
+
+//A Beta above 1 refreshes entries earlier, below 1 later.
+//The RefreshTimeout bounds the loads of missed and refreshed entries, which don't stop with the requests that started them.
+type CacheConfig struct {
+	ItemTTL        time.Duration
+	ListTTL        time.Duration
+	Beta           float64
+	RefreshTimeout time.Duration
+}
+
+func NewCacheConfig() CacheConfig {
+	return CacheConfig{
+		ItemTTL:        utils.GetEnvDuration("ITEMS_CACHE_ITEM_TTL", 5*time.Minute),
+		ListTTL:        utils.GetEnvDuration("ITEMS_CACHE_LIST_TTL", 30*time.Second),
+		Beta:           1,
+		RefreshTimeout: utils.GetEnvDuration("ITEMS_CACHE_REFRESH_TIMEOUT", 5*time.Second),
+	}
+}
+
+//Delta and Expiry are in milliseconds, for the early refresh.
+type cacheEntry struct {
+	Value  json.RawMessage `json:"value"`
+	Delta  int64           `json:"delta"`
+	Expiry int64           `json:"expiry"`
+}
+
+//A load that started before a write may still cache the old value; the TTLs bound how long it is served.
+type cachedService struct {
+	Service
+	cache  Cache
+	config CacheConfig
+	group  singleflight.Group
+}
+
+//Cache errors are logged and counted, and the request falls through to the service.
+func NewCachedService(s Service, c Cache, config CacheConfig) Service {
+	return &cachedService{Service: s, cache: c, config: config}
+}
+
+func (s *cachedService) GetItem(ctx context.Context, itemId int) (*ItemGet, error) {
+	item := ItemGet{}
+	load := func(ctx context.Context) (interface{}, error) { return s.Service.GetItem(ctx, itemId) }
+	if err := s.fetch(ctx, fmt.Sprintf(itemCacheKey, itemId), itemsCacheKeys, s.config.ItemTTL, &item, load); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (s *cachedService) GetItems(ctx context.Context, limit int) (*[]ItemGet, error) {
+	items := make([]ItemGet, 0)
+	load := func(ctx context.Context) (interface{}, error) { return s.Service.GetItems(ctx, limit) }
+	if err := s.fetch(ctx, fmt.Sprintf(listCacheKey, limit), listsCacheKeys, s.config.ListTTL, &items, load); err != nil {
+		return nil, err
+	}
+	return &items, nil
+}
+
+func (s *cachedService) InsertItem(ctx context.Context, post *ItemPost) (int, error) {
+	id, err := s.Service.InsertItem(ctx, post)
+	if err == nil {
+		s.invalidate(ctx)
+	}
+	return id, err
+}
+
+func (s *cachedService) UpdateItem(ctx context.Context, item *ItemPatch) (int, error) {
+	rowsAffected, err := s.Service.UpdateItem(ctx, item)
+	if err == nil {
+		s.invalidate(ctx, item.Id)
+	}
+	return rowsAffected, err
+}
+
+func (s *cachedService) PatchItem(ctx context.Context, current *ItemDocument, patched *ItemDocument, modifiedAt int) (int, error) {
+	rowsAffected, err := s.Service.PatchItem(ctx, current, patched, modifiedAt)
+	if err == nil && rowsAffected != 0 {
+		s.invalidate(ctx, current.Id)
+	}
+	return rowsAffected, err
+}
+
+func (s *cachedService) DeleteItem(ctx context.Context, itemId int, version int) (int, error) {
+	rowsAffected, err := s.Service.DeleteItem(ctx, itemId, version)
+	if err == nil {
+		s.invalidate(ctx, itemId)
+	}
+	return rowsAffected, err
+}
+
+func (s *cachedService) InsertItemDiscounts(ctx context.Context, itemdiscounts []ItemDiscount) error {
+	if err := s.Service.InsertItemDiscounts(ctx, itemdiscounts); err != nil {
+		return err
+	}
+	itemIds := make([]int, 0, len(itemdiscounts))
+	for _, itemdis := range itemdiscounts {
+		itemId, err := strconv.Atoi(itemdis.ItemId)
+		if err != nil {
+			s.invalidateAll(ctx)
+			return nil
+		}
+		itemIds = append(itemIds, itemId)
+	}
+	s.invalidate(ctx, itemIds...)
+	return nil
+}
+
+func (s *cachedService) DeleteDiscounts(ctx context.Context, discounts []Discount) error {
+	if err := s.Service.DeleteDiscounts(ctx, discounts); err != nil {
+		return err
+	}
+	s.invalidateAll(ctx)
+	return nil
+}
+
+//Deleting categories, sizes or locations invalidates every cached item and listing, since the cache doesn't know which items referred to them.
+func (s *cachedService) DeleteCategory(ctx context.Context, category *ItemCategory) error {
+	if err := s.Service.DeleteCategory(ctx, category); err != nil {
+		return err
+	}
+	s.invalidateAll(ctx)
+	return nil
+}
+
+func (s *cachedService) DeleteSizes(ctx context.Context, sizes []Size) error {
+	if err := s.Service.DeleteSizes(ctx, sizes); err != nil {
+		return err
+	}
+	s.invalidateAll(ctx)
+	return nil
+}
+
+func (s *cachedService) DeleteLocations(ctx context.Context, locations []Location) error {
+	if err := s.Service.DeleteLocations(ctx, locations); err != nil {
+		return err
+	}
+	s.invalidateAll(ctx)
+	return nil
+}
+
+//Concurrent misses of the same key share one load. Shortly before an entry expires it is refreshed in the background with a probability that grows as the expiry nears (XFetch), so hot keys don't all expire at once.
+func (s *cachedService) fetch(ctx context.Context, key string, index string, ttl time.Duration, dest interface{}, load func(ctx context.Context) (interface{}, error)) error {
+	data, err := s.cache.GetKey(ctx, key)
+	if err == nil {
+		entry := cacheEntry{}
+		if err := json.Unmarshal([]byte(data), &entry); err == nil {
+			cacheMetrics.Add("hits", 1)
+			if s.refreshEarly(entry) {
+				cacheMetrics.Add("early_refreshes", 1)
+				s.loadShared(key, index, ttl, load)
+			}
+			return json.Unmarshal(entry.Value, dest)
+		}
+	} else if !errors.Is(err, apperrors.ErrNotFound) {
+		cacheError("get", key, err)
+	}
+	cacheMetrics.Add("misses", 1)
+	select {
+	case result := <-s.loadShared(key, index, ttl, load):
+		if result.Err != nil {
+			return result.Err
+		}
+		return json.Unmarshal(result.Val.(json.RawMessage), dest)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//A shared load doesn't belong to any one of the requests waiting for it, so it runs with its own deadline and goes on if they are canceled.
+func (s *cachedService) loadShared(key string, index string, ttl time.Duration, load func(ctx context.Context) (interface{}, error)) <-chan singleflight.Result {
+	return s.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.RefreshTimeout)
+		defer cancel()
+		return s.load(ctx, key, index, ttl, load)
+	})
+}
+
+func (s *cachedService) load(ctx context.Context, key string, index string, ttl time.Duration, load func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	value, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := json.Marshal(cacheEntry{Value: data, Delta: time.Since(start).Milliseconds(), Expiry: time.Now().Add(ttl).UnixMilli()})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.AddToSet(ctx, index, ttl, key); err != nil {
+		cacheError("index", key, err)
+	} else if err := s.cache.SetKey(ctx, key, entry, ttl); err != nil {
+		cacheError("set", key, err)
+	}
+	return json.RawMessage(data), nil
+}
+
+func (s *cachedService) refreshEarly(entry cacheEntry) bool {
+	gap := -float64(entry.Delta) * s.config.Beta * math.Log(1-rand.Float64())
+	return float64(time.Now().UnixMilli())+gap >= float64(entry.Expiry)
+}
+
+func (s *cachedService) invalidate(ctx context.Context, itemIds ...int) {
+	keys, err := s.cache.GetSetMembers(ctx, listsCacheKeys)
+	if err != nil {
+		cacheError("invalidate", listsCacheKeys, err)
+	}
+	keys = append(keys, listsCacheKeys)
+	for _, itemId := range itemIds {
+		key := fmt.Sprintf(itemCacheKey, itemId)
+		s.group.Forget(key)
+		keys = append(keys, key)
+	}
+	if _, err := s.cache.DeleteKeys(ctx, keys...); err != nil {
+		cacheError("invalidate", listsCacheKeys, err)
+	}
+}
+
+func (s *cachedService) invalidateAll(ctx context.Context) {
+	keys := []string{itemsCacheKeys, listsCacheKeys}
+	for _, index := range []string{itemsCacheKeys, listsCacheKeys} {
+		members, err := s.cache.GetSetMembers(ctx, index)
+		if err != nil {
+			cacheError("invalidate", index, err)
+		}
+		keys = append(keys, members...)
+	}
+	if _, err := s.cache.DeleteKeys(ctx, keys...); err != nil {
+		cacheError("invalidate", itemsCacheKeys, err)
+	}
+}
+
+var cacheErrorAt int64
+
+//Every request fails the same way while Redis is down, so errors are counted each time but logged at most once a minute.
+func cacheError(operation string, key string, err error) {
+	cacheMetrics.Add("errors", 1)
+	now := time.Now().UnixNano()
+	reportedAt := atomic.LoadInt64(&cacheErrorAt)
+	if now-reportedAt < int64(time.Minute) || !atomic.CompareAndSwapInt64(&cacheErrorAt, reportedAt, now) {
+		return
+	}
+	log.Printf("items cache: %s %s: %v", operation, key, err)
+}
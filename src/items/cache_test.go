@@ -0,0 +1,286 @@
+package items
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+type memoryCache struct {
+	mu   sync.Mutex
+	keys map[string]string
+	sets map[string]map[string]bool
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{keys: map[string]string{}, sets: map[string]map[string]bool{}}
+}
+
+func (c *memoryCache) GetKey(ctx context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, ok := c.keys[key]; ok {
+		return value, nil
+	}
+	return "", apperrors.NotFound("not_found", "not found")
+}
+
+func (c *memoryCache) SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[key] = fmt.Sprintf("%s", value)
+	return nil
+}
+
+func (c *memoryCache) DeleteKeys(ctx context.Context, keys ...string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.keys[key]; ok {
+			deleted++
+		}
+		delete(c.keys, key)
+		delete(c.sets, key)
+	}
+	return deleted, nil
+}
+
+func (c *memoryCache) AddToSet(ctx context.Context, key string, exp time.Duration, members ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sets[key] == nil {
+		c.sets[key] = map[string]bool{}
+	}
+	for _, member := range members {
+		c.sets[key][fmt.Sprint(member)] = true
+	}
+	return nil
+}
+
+func (c *memoryCache) GetSetMembers(ctx context.Context, key string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var members []string
+	for member := range c.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (c *memoryCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.keys[key]
+	return ok
+}
+
+//A read blocks until release is closed, if it is set, or its context is done.
+type countingService struct {
+	Service
+	loads   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *countingService) GetItem(ctx context.Context, itemId int) (*ItemGet, error) {
+	loads := atomic.AddInt32(&s.loads, 1)
+	if s.started != nil {
+		s.started <- struct{}{}
+	}
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &ItemGet{Id: itemId, Version: int(loads)}, nil
+}
+
+func (s *countingService) GetItems(ctx context.Context, limit int) (*[]ItemGet, error) {
+	atomic.AddInt32(&s.loads, 1)
+	return &[]ItemGet{{Id: 1}}, nil
+}
+
+func (s *countingService) UpdateItem(ctx context.Context, item *ItemPatch) (int, error) {
+	return 1, nil
+}
+
+func (s *countingService) DeleteCategory(ctx context.Context, category *ItemCategory) error {
+	return nil
+}
+
+func (s *countingService) DeleteSizes(ctx context.Context, sizes []Size) error {
+	return nil
+}
+
+func (s *countingService) DeleteLocations(ctx context.Context, locations []Location) error {
+	return nil
+}
+
+func newTestCache(s Service, c Cache) *cachedService {
+	return &cachedService{Service: s, cache: c, config: CacheConfig{ItemTTL: time.Minute, ListTTL: time.Minute, Beta: 1, RefreshTimeout: time.Second}}
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	ctx := context.Background()
+	service := &countingService{}
+	s := newTestCache(service, newMemoryCache())
+	for i := 0; i < 3; i++ {
+		item, err := s.GetItem(ctx, 1)
+		if err != nil || item.Id != 1 || item.Version != 1 {
+			t.Fatalf("item %+v: %v", item, err)
+		}
+	}
+	if loads := atomic.LoadInt32(&service.loads); loads != 1 {
+		t.Errorf("%d loads for cached reads", loads)
+	}
+	if _, err := s.UpdateItem(ctx, &ItemPatch{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := s.GetItem(ctx, 1); err != nil || item.Version != 2 {
+		t.Errorf("item after an update %+v: %v", item, err)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	deletes := map[string]func(s Service) error{
+		"category":  func(s Service) error { return s.DeleteCategory(ctx, &ItemCategory{Name: "shoes"}) },
+		"sizes":     func(s Service) error { return s.DeleteSizes(ctx, []Size{{Id: 1}}) },
+		"locations": func(s Service) error { return s.DeleteLocations(ctx, []Location{{Id: 1}}) },
+	}
+	for name, remove := range deletes {
+		cache := newMemoryCache()
+		s := newTestCache(&countingService{}, cache)
+		if _, err := s.GetItem(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetItems(ctx, 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := remove(s); err != nil {
+			t.Fatal(err)
+		}
+		if cache.has(fmt.Sprintf(itemCacheKey, 1)) || cache.has(fmt.Sprintf(listCacheKey, 10)) {
+			t.Errorf("delete of %s left cached entries: %v", name, cache.keys)
+		}
+	}
+}
+
+func TestConcurrentMissesShareOneLoad(t *testing.T) {
+	ctx := context.Background()
+	service := &countingService{started: make(chan struct{}, 10), release: make(chan struct{})}
+	s := newTestCache(service, newMemoryCache())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if item, err := s.GetItem(ctx, 1); err != nil || item.Version != 1 {
+				t.Errorf("item %+v: %v", item, err)
+			}
+		}()
+	}
+	<-service.started
+	//give the other reads time to miss and join the load
+	time.Sleep(50 * time.Millisecond)
+	close(service.release)
+	wg.Wait()
+	if loads := atomic.LoadInt32(&service.loads); loads != 1 {
+		t.Errorf("%d loads for concurrent misses", loads)
+	}
+}
+
+func TestCanceledReadDoesntFailTheSharedLoad(t *testing.T) {
+	service := &countingService{started: make(chan struct{}, 2), release: make(chan struct{})}
+	s := newTestCache(service, newMemoryCache())
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := s.GetItem(ctx, 1)
+		canceled <- err
+	}()
+	<-service.started
+	waited := make(chan error)
+	go func() {
+		_, err := s.GetItem(context.Background(), 1)
+		waited <- err
+	}()
+	//give the second read time to join the load
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled read: %v", err)
+	}
+	close(service.release)
+	if err := <-waited; err != nil {
+		t.Errorf("read sharing the load of a canceled read: %v", err)
+	}
+	if loads := atomic.LoadInt32(&service.loads); loads != 1 {
+		t.Errorf("%d loads", loads)
+	}
+}
+
+func TestRefreshEarly(t *testing.T) {
+	s := newTestCache(nil, nil)
+	now := time.Now().UnixMilli()
+	for i := 0; i < 100; i++ {
+		if s.refreshEarly(cacheEntry{Delta: 10, Expiry: now + time.Hour.Milliseconds()}) {
+			t.Fatal("an entry an hour from expiry that loads in 10ms was refreshed")
+		}
+		if !s.refreshEarly(cacheEntry{Delta: 10, Expiry: now}) {
+			t.Fatal("an expired entry wasn't refreshed")
+		}
+	}
+	refreshed := 0
+	for i := 0; i < 1000; i++ {
+		if s.refreshEarly(cacheEntry{Delta: time.Minute.Milliseconds(), Expiry: now + time.Minute.Milliseconds()}) {
+			refreshed++
+		}
+	}
+	//with the expiry one load time away, an entry is refreshed with a probability of about 1/e
+	if refreshed < 250 || refreshed > 500 {
+		t.Errorf("refreshed %d of 1000 times", refreshed)
+	}
+}
+
+func TestEarlyRefreshServesTheCachedValue(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache()
+	service := &countingService{started: make(chan struct{}, 1)}
+	s := newTestCache(service, cache)
+	value, err := json.Marshal(ItemGet{Id: 1, Version: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := json.Marshal(cacheEntry{Value: value, Delta: 10, Expiry: time.Now().UnixMilli()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf(itemCacheKey, 1)
+	cache.keys[key] = string(entry)
+	if item, err := s.GetItem(ctx, 1); err != nil || item.Version != 100 {
+		t.Fatalf("item %+v: %v", item, err)
+	}
+	select {
+	case <-service.started:
+	case <-time.After(time.Second):
+		t.Fatal("the entry wasn't refreshed")
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		data, _ := cache.GetKey(ctx, key)
+		if data != string(entry) {
+			return
+		}
+	}
+	t.Error("the refreshed value wasn't cached")
+}
@@ -3,11 +3,17 @@ package items
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	M "github.com/fnmzgdt/e_shop/src/middleware"
+	"github.com/fnmzgdt/e_shop/src/patch"
 	"github.com/fnmzgdt/e_shop/src/responses"
+	"github.com/fnmzgdt/e_shop/src/validation"
 )
 
 func getItem(s Service) func(w http.ResponseWriter, r *http.Request) {
@@ -17,15 +23,18 @@ func getItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		item, err := s.GetItem(itemId)
+		item, err := s.GetItem(r.Context(), itemId)
 		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				responses.JSONError(w, "Item not found", http.StatusNotFound)
-				return
-			}
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
+		etag := responses.ETag(item.Version)
+		w.Header().Set("ETag", etag)
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && responses.ETagMatches(ifNoneMatch, etag, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Accept-Patch", acceptPatch)
 		responses.JSONResponse(w, "Success.", []ItemGet{*item}, http.StatusOK)
 		return
 	}
@@ -33,9 +42,9 @@ func getItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func getItems(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		items, err := s.GetItems(10)
+		items, err := s.GetItems(r.Context(), 10)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		responses.JSONResponse(w, "Success.", *items, http.StatusOK)
@@ -45,19 +54,19 @@ func getItems(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func postItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId, _ := strconv.Atoi(r.Header.Get("userId"))
+		userId, _ := strconv.Atoi(userIdFromRequest(r))
 		item := NewItemPost(userId)
 		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
 			responses.JSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := item.checkFields(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+		if err := item.checkFields(r.Context(), s); err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		lastId, err := s.InsertItem(&item)
+		lastId, err := s.InsertItem(r.Context(), &item)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		item.Id = lastId
@@ -73,29 +82,116 @@ func updateItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case patch.MergePatchType, patch.JSONPatchType, "", "application/json":
+		default:
+			w.Header().Set("Accept-Patch", acceptPatch)
+			responses.JSONErrorCode(w, fmt.Sprintf("Unsupported patch format %s", mediaType), "unsupported_patch_format", http.StatusUnsupportedMediaType)
+			return
+		}
+		current, ok := ifMatchItem(s, w, r, itemId)
+		if !ok {
+			return
+		}
+		if mediaType == patch.MergePatchType || mediaType == patch.JSONPatchType {
+			patchItem(s, w, r, current, mediaType)
+			return
+		}
 		item := NewItemPatch(itemId)
+		item.Version = current.Version
 		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
 			responses.JSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := item.checkFields(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+		if err := item.checkFields(r.Context(), s, *current); err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		rowsAffected, err := s.UpdateItem(&item)
-		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		if item.changesPrice() && !M.HasPermission(r, M.PricesWrite) {
+			responses.JSONError(w, fmt.Sprintf("Changing prices requires the %s permission", M.PricesWrite), http.StatusForbidden)
 			return
 		}
-		if rowsAffected == 0 {
-			responses.JSONResponse(w, fmt.Sprintf("Successfully updated %d rows", rowsAffected), nil, http.StatusNoContent)
+		rowsAffected, err := s.UpdateItem(r.Context(), &item)
+		if err != nil {
+			responses.Error(w, r, err)
 			return
 		}
+		w.Header().Set("ETag", responses.ETag(item.Version+1))
 		responses.JSONResponse(w, fmt.Sprintf("Successfully updated %d rows", rowsAffected), item, http.StatusOK)
 		return
 	}
 }
 
+var acceptPatch = strings.Join([]string{patch.MergePatchType, patch.JSONPatchType, "application/json"}, ", ")
+
+const maxPatchSize = 64 << 10
+
+func ifMatchItem(s Service, w http.ResponseWriter, r *http.Request, itemId int) (*ItemDocument, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		responses.JSONErrorCode(w, "Include the ETag of the item in the If-Match header", "precondition_required", http.StatusPreconditionRequired)
+		return nil, false
+	}
+	current, err := s.GetItemDocument(r.Context(), itemId)
+	if err != nil {
+		responses.Error(w, r, err)
+		return nil, false
+	}
+	if !responses.ETagMatches(ifMatch, responses.ETag(current.Version), false) {
+		w.Header().Set("ETag", responses.ETag(current.Version))
+		responses.Error(w, r, ErrItemModified)
+		return nil, false
+	}
+	return current, true
+}
+
+func patchItem(s Service, w http.ResponseWriter, r *http.Request, current *ItemDocument, mediaType string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+	if err != nil {
+		responses.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	document, err := json.Marshal(current)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if mediaType == patch.MergePatchType {
+		document, err = patch.Merge(document, body)
+	} else {
+		document, err = patch.Apply(document, body)
+	}
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	item, err := decodeItemDocument(document)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if err := item.checkFields(r.Context(), s, *current); err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if item.changesPrice(*current) && !M.HasPermission(r, M.PricesWrite) {
+		responses.JSONError(w, fmt.Sprintf("Changing prices requires the %s permission", M.PricesWrite), http.StatusForbidden)
+		return
+	}
+	rowsAffected, err := s.PatchItem(r.Context(), current, &item, int(time.Now().Unix()))
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	version := current.Version
+	if rowsAffected != 0 {
+		version++
+	}
+	w.Header().Set("ETag", responses.ETag(version))
+	responses.JSONResponse(w, fmt.Sprintf("Successfully updated %d rows", rowsAffected), item, http.StatusOK)
+}
+
 func deleteItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		itemId, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/items/items/"))
@@ -103,13 +199,13 @@ func deleteItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		rowsAffected, err := s.DeleteItem(itemId)
-		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		current, ok := ifMatchItem(s, w, r, itemId)
+		if !ok {
 			return
 		}
-		if rowsAffected == 0 {
-			responses.JSONResponse(w, fmt.Sprintf("Successfully updated %d rows", rowsAffected), nil, http.StatusNoContent)
+		rowsAffected, err := s.DeleteItem(r.Context(), itemId, current.Version)
+		if err != nil {
+			responses.Error(w, r, err)
 			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully updated %d rows", rowsAffected), nil, http.StatusOK)
@@ -120,16 +216,16 @@ func deleteItem(s Service) func(w http.ResponseWriter, r *http.Request) {
 func postCategory(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// check for special claims
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		category := newItemCategory(userId)
 		_ = json.NewDecoder(r.Body).Decode(&category)
 		if err := category.checkFields(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			responses.Error(w, r, err)
 			return
 		}
-		lastId, err := s.InsertCategory(&category)
+		lastId, err := s.InsertCategory(r.Context(), &category)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		category.Id = int(lastId)
@@ -140,16 +236,16 @@ func postCategory(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func deleteCategory(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		category := newItemCategory(userId)
 		_ = json.NewDecoder(r.Body).Decode(&category)
 		if err := category.checkName(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			responses.Error(w, r, err)
 			return
 		}
 		//deletes the category and all its subcategories if any
-		if err := s.DeleteCategory(&category); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		if err := s.DeleteCategory(r.Context(), &category); err != nil {
+			responses.Error(w, r, err)
 			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully deleted category %s", category.Name), nil, 200)
@@ -159,16 +255,16 @@ func deleteCategory(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func postBrand(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		brand := createBrand(userId)
 		_ = json.NewDecoder(r.Body).Decode(&brand)
 		if err := brand.checkFields(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			responses.Error(w, r, err)
 			return
 		}
-		lastId, err := s.InsertBrand(&brand)
+		lastId, err := s.InsertBrand(r.Context(), &brand)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		brand.Id = int(lastId)
@@ -184,7 +280,7 @@ func deleteBrand(s Service) {
 
 func postSizes(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		var sizes []Size
 		_ = json.NewDecoder(r.Body).Decode(&sizes)
 
@@ -192,20 +288,18 @@ func postSizes(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, "Include at least one size", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(sizes); i++ {
 			sizes[i].setUserId(userId)
-			if err := sizes[i].checkFields(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), sizes[i].checkFields())
 		}
-		for i := 0; i < len(sizes); i++ {
-			lastId, err := s.InsertSize(&sizes[i])
-			if err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			sizes[i].setId(lastId)
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.InsertSizes(r.Context(), sizes); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully inserted %d sizes.", len(sizes)), sizes, 200)
 		return
@@ -221,17 +315,17 @@ func deleteSizes(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(sizes); i++ {
-			if err := sizes[i].checkName(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), sizes[i].checkName())
 		}
-		for i := 0; i < len(sizes); i++ {
-			if err := s.DeleteSize(&sizes[i]); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.DeleteSizes(r.Context(), sizes); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully deleted sizes %v", sizes), nil, 200)
 		return
@@ -240,27 +334,25 @@ func deleteSizes(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func postLocations(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		var locations []Location
 		_ = json.NewDecoder(r.Body).Decode(&locations)
 		if len(locations) == 0 {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(locations); i++ {
 			locations[i].setUserId(userId)
-			if err := locations[i].checkFields(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), locations[i].checkFields())
 		}
-		for i := 0; i < len(locations); i++ {
-			lastId, err := s.InsertLocation(&locations[i])
-			if err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			locations[i].setId(lastId)
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.InsertLocations(r.Context(), locations); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, "Successful entry", locations, 200)
 		return
@@ -276,17 +368,17 @@ func deleteLocations(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(locations); i++ {
-			if err := locations[i].checkId(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), locations[i].checkId())
 		}
-		for i := 0; i < len(locations); i++ {
-			if err := s.DeleteLocation(&locations[i]); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.DeleteLocations(r.Context(), locations); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully deleted locations %v", locations), nil, 200)
 		return
@@ -295,34 +387,32 @@ func deleteLocations(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 func postDiscounts(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userId := r.Header.Get("userId")
+		userId := userIdFromRequest(r)
 		var discounts []Discount
 		_ = json.NewDecoder(r.Body).Decode(&discounts)
 		if len(discounts) == 0 {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(discounts); i++ {
 			discounts[i].setUserId(userId)
-			if err := discounts[i].checkFields(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), discounts[i].checkFields())
 		}
-		for i := 0; i < len(discounts); i++ {
-			lastId, err := s.InsertDiscount(&discounts[i])
-			if err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			discounts[i].setId(lastId)
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.InsertDiscounts(r.Context(), discounts); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, "Successful entry", discounts, 200)
 		return
 	}
 }
 
-//deleting discount deletes all items_discount pairs
+// deleting discount deletes all items_discount pairs
 func deleteDiscounts(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var discounts []Discount
@@ -331,17 +421,17 @@ func deleteDiscounts(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(discounts); i++ {
-			if err := discounts[i].checkId(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), discounts[i].checkId())
 		}
-		for i := 0; i < len(discounts); i++ {
-			if err := s.DeleteDiscount(&discounts[i]); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.DeleteDiscounts(r.Context(), discounts); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully deleted locations %v", discounts), nil, 200)
 		return
@@ -356,17 +446,17 @@ func applyDiscounts(s Service) func(w http.ResponseWriter, r *http.Request) {
 			responses.JSONError(w, "Empty request body", http.StatusBadRequest)
 			return
 		}
+		v := validation.New()
 		for i := 0; i < len(itemdiscounts); i++ {
-			if err := itemdiscounts[i].checkFields(); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			v.Merge(fmt.Sprintf("[%d]", i), itemdiscounts[i].checkFields(r.Context(), s))
 		}
-		for i := 0; i < len(itemdiscounts); i++ {
-			if err := s.InsertItemDiscount(&itemdiscounts[i]); err != nil {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err := v.Err(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.InsertItemDiscounts(r.Context(), itemdiscounts); err != nil {
+			responses.Error(w, r, err)
+			return
 		}
 		responses.JSONResponse(w, fmt.Sprintf("Successfully applied discounts %v", itemdiscounts), itemdiscounts, 200)
 		return
@@ -390,3 +480,11 @@ func deleteInventories(s Service) func(w http.ResponseWriter, r *http.Request) {
 
 	}
 }
+
+func userIdFromRequest(r *http.Request) string {
+	principal, ok := M.PrincipalFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return principal.UserId
+}
@@ -0,0 +1,55 @@
+package items
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fnmzgdt/e_shop/src/responses"
+)
+
+type itemsService struct {
+	Service
+	documents map[int]ItemDocument
+	updated   []int
+}
+
+func (s *itemsService) GetItemDocument(ctx context.Context, itemId int) (*ItemDocument, error) {
+	document := s.documents[itemId]
+	return &document, nil
+}
+
+func (s *itemsService) UpdateItem(ctx context.Context, item *ItemPatch) (int, error) {
+	s.updated = append(s.updated, item.Id)
+	return 1, nil
+}
+
+func TestUpdateItemKeepsTheIdOfTheURL(t *testing.T) {
+	s := &itemsService{documents: map[int]ItemDocument{
+		1: {Id: 1, CategoryId: 1, Price: 100, Description: "shoe", Version: 3},
+		2: {Id: 2, CategoryId: 1, Price: 100, Description: "boot", Version: 1},
+	}}
+	tests := []struct {
+		body    string
+		status  int
+		updated []int
+	}{
+		{`{"id": 2, "description": "sneaker"}`, http.StatusBadRequest, nil},
+		{`{"id": 0, "description": "sneaker"}`, http.StatusBadRequest, nil},
+		{`{"id": 1, "description": "sneaker"}`, http.StatusOK, []int{1}},
+		{`{"description": "sneaker"}`, http.StatusOK, []int{1}},
+	}
+	for _, test := range tests {
+		s.updated = nil
+		r := httptest.NewRequest(http.MethodPatch, "/api/items/items/1", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("If-Match", responses.ETag(3))
+		w := httptest.NewRecorder()
+		updateItem(s)(w, r)
+		if w.Code != test.status || len(s.updated) != len(test.updated) || (len(s.updated) > 0 && s.updated[0] != test.updated[0]) {
+			t.Errorf("%s: status %d, updated %v", test.body, w.Code, s.updated)
+		}
+	}
+}
@@ -1,11 +1,27 @@
 package items
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
 	"strings"
 	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/validation"
+)
+
+const (
+	maxDescriptionLength  = 5000
+	maxNameLength         = 100
+	maxAddressLength      = 255
+	maxDiscountCodeLength = 50
 )
 
+var discountAmountRegex = regexp.MustCompile(`^\d+(\.\d{1,2})?%?$`)
+
 type ItemGet struct {
 	Id              int    `json:"id,omitempty"`
 	UserId          int    `json:"userId,omitempty"`
@@ -17,6 +33,7 @@ type ItemGet struct {
 	Description     string `json:"description,omitempty"`
 	ModifiedAt      int    `json:"modifiedAt,omitempty"`
 	DeletedAt       int    `json:"deletedAt,omitempty"`
+	Version         int    `json:"version,omitempty"`
 }
 
 type ItemPost struct {
@@ -35,28 +52,23 @@ func NewItemPost(userId int) ItemPost {
 	return ItemPost{UserId: userId, CreatedAt: now}
 }
 
-func (item ItemPost) checkFields() error {
-	if item.UserId == 0 {
-		return errors.New("UserId field can't be empty.")
-	}
-	if item.CategoryId == 0 {
-		return errors.New("CategoryId field can't be empty.")
-	}
-	if item.BrandId == 0 {
-		return errors.New("BrandId field can't be empty.")
-	}
-	if item.CreatedAt == 0 {
-		return errors.New("CreatedAt field can't be empty.")
+func (item ItemPost) checkFields(ctx context.Context, s Service) error {
+	v := validation.New()
+	v.Int("userId", item.UserId).Required()
+	v.Int("categoryId", item.CategoryId).Required().Exists(func() (bool, error) { return s.CategoryExists(ctx, item.CategoryId) })
+	v.Int("brandId", item.BrandId).Required().Exists(func() (bool, error) { return s.BrandExists(ctx, item.BrandId) })
+	v.Int("createdAt", item.CreatedAt).Required()
+	v.Int("price", item.Price).Required().Min(1)
+	discountedPrice := v.Int("discountedPrice", item.DiscountedPrice).Min(1)
+	if item.Price > 0 {
+		discountedPrice.Max(int64(item.Price) - 1)
 	}
-	if item.Price == 0 {
-		return errors.New("Price field can't be empty.")
-	}
-	if strings.TrimSpace(item.Description) == "" {
-		return errors.New("Description field can't be empty.")
-	}
-	return nil
+	v.String("description", item.Description).Required().MaxLength(maxDescriptionLength)
+	return v.Err()
 }
 
+//In a PATCH sent as application/json zero values mean "not provided"; the Discount and ChangeDeleted flags are needed to clear a column.
+//Clients that need to set zero values or null should send a merge patch or a JSON patch, which are applied to the ItemDocument.
 type ItemPatch struct {
 	Id              int    `json:"id,omitempty"`
 	CategoryId      int    `json:"categoryId,omitempty"`
@@ -68,6 +80,7 @@ type ItemPatch struct {
 	ModifiedAt      int    `json:"modifiedAt,omitempty"`
 	ChangeDeleted   bool   `json:"changeDeleted,omitempty"`
 	DeletedAt       int    `json:"deletedAt,omitempty"`
+	Version         int    `json:"-"`
 }
 
 func NewItemPatch(itemId int) ItemPatch {
@@ -75,17 +88,112 @@ func NewItemPatch(itemId int) ItemPatch {
 	return ItemPatch{Id: itemId, ModifiedAt: now}
 }
 
-func (item ItemPatch) checkFields() error {
-	if item.Id == 0 {
-		return errors.New("Wrong URL Path.")
+//The prices are checked against the current ones of the item for the fields the patch leaves out.
+func (item ItemPatch) checkFields(ctx context.Context, s Service, current ItemDocument) error {
+	v := validation.New()
+	v.Check("id", item.Id == current.Id, "read_only", "Id can't be changed.")
+	v.Int("modifiedAt", item.ModifiedAt).Required()
+	v.Check("", item.CategoryId != 0 || item.BrandId != 0 || item.Price != 0 || item.DeletedAt != 0 || strings.TrimSpace(item.Description) != "" || item.DiscountedPrice != 0 || item.Discount, "no_changes", "Include fields to be updated.")
+	v.Int("categoryId", item.CategoryId).Exists(func() (bool, error) { return s.CategoryExists(ctx, item.CategoryId) })
+	v.Int("brandId", item.BrandId).Exists(func() (bool, error) { return s.BrandExists(ctx, item.BrandId) })
+	price := v.Int("price", item.Price).Min(1)
+	if item.DiscountedPrice != 0 {
+		resultingPrice := current.Price
+		if item.Price != 0 {
+			resultingPrice = item.Price
+		}
+		checkDiscountedPrice(v, item.DiscountedPrice, resultingPrice)
+	} else if !item.Discount && current.DiscountedPrice != nil {
+		price.Min(int64(*current.DiscountedPrice) + 1)
 	}
-	if item.ModifiedAt == 0 {
-		return errors.New("ModifiedAt field can't be empty.")
+	v.String("description", item.Description).MaxLength(maxDescriptionLength)
+	return v.Err()
+}
+
+func checkDiscountedPrice(v *validation.Validator, discountedPrice int, price int) {
+	if price <= 0 {
+		v.Check("discountedPrice", false, "no_price", "An item without a price can't have a discounted price.")
+		return
 	}
-	if item.CategoryId == 0 && item.BrandId == 0 && item.Price == 0 && item.DeletedAt == 0 && strings.TrimSpace(item.Description) == "" && item.DiscountedPrice == 0 && item.Discount == false {
-		return errors.New("Include fields to be updated.")
+	v.Int("discountedPrice", discountedPrice).Required().Min(1).Max(int64(price) - 1)
+}
+
+func (item ItemPatch) changesPrice() bool {
+	return item.Price != 0 || item.Discount
+}
+
+//A null brandId, discountedPrice or deletedAt clears the column.
+//The Version is sent in the ETag header rather than in the document, so a patch can't change it.
+type ItemDocument struct {
+	Id              int    `json:"id"`
+	CategoryId      int    `json:"categoryId"`
+	BrandId         *int   `json:"brandId"`
+	Price           int    `json:"price"`
+	DiscountedPrice *int   `json:"discountedPrice"`
+	Description     string `json:"description"`
+	DeletedAt       *int   `json:"deletedAt"`
+	Version         int    `json:"-"`
+}
+
+var requiredMembers = []string{"id", "categoryId", "price", "description"}
+
+func decodeItemDocument(data []byte) (ItemDocument, error) {
+	item := ItemDocument{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&item); err != nil {
+		return item, apperrors.New(apperrors.ErrValidation, "invalid_item", fmt.Sprintf("The patched item is invalid: %s", err), err)
 	}
-	return nil
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return item, err
+	}
+	v := validation.New()
+	for _, name := range requiredMembers {
+		value, ok := members[name]
+		v.Check(name, ok && string(value) != "null", "required", fmt.Sprintf("%s%s can't be removed.", strings.ToUpper(name[:1]), name[1:]))
+	}
+	return item, v.Err()
+}
+
+func (item ItemDocument) checkFields(ctx context.Context, s Service, current ItemDocument) error {
+	v := validation.New()
+	v.Check("id", item.Id == current.Id, "read_only", "Id can't be changed.")
+	categoryId := v.Int("categoryId", item.CategoryId).Required()
+	if item.CategoryId != current.CategoryId {
+		categoryId.Exists(func() (bool, error) { return s.CategoryExists(ctx, item.CategoryId) })
+	}
+	if item.BrandId != nil {
+		brandId := v.Int("brandId", *item.BrandId).Required()
+		if !sameInt(item.BrandId, current.BrandId) {
+			brandId.Exists(func() (bool, error) { return s.BrandExists(ctx, *item.BrandId) })
+		}
+	}
+	v.Int("price", item.Price).Min(0)
+	if item.DiscountedPrice != nil {
+		checkDiscountedPrice(v, *item.DiscountedPrice, item.Price)
+	}
+	v.String("description", item.Description).MaxLength(maxDescriptionLength)
+	if item.DeletedAt != nil {
+		v.Int("deletedAt", *item.DeletedAt).Required().Min(0)
+	}
+	return v.Err()
+}
+
+func (item ItemDocument) changesPrice(current ItemDocument) bool {
+	return item.Price != current.Price || !sameInt(item.DiscountedPrice, current.DiscountedPrice)
+}
+
+func (item ItemDocument) sameAs(current ItemDocument) bool {
+	return item.CategoryId == current.CategoryId && sameInt(item.BrandId, current.BrandId) && !item.changesPrice(current) &&
+		item.Description == current.Description && sameInt(item.DeletedAt, current.DeletedAt)
+}
+
+func sameInt(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
 
 type ItemCategory struct {
@@ -100,23 +208,17 @@ func newItemCategory(userId string) ItemCategory {
 }
 
 func (c ItemCategory) checkFields() error {
-	if strings.TrimSpace(c.Name) == "" {
-		return errors.New("Category Name field can't be empty.")
-	}
-	if strings.TrimSpace(c.ParentName) == "" {
-		return errors.New("Parent Category Name field can't be empty.")
-	}
-	if strings.TrimSpace(c.UserId) == "" {
-		return errors.New("User Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("name", c.Name).Required().MaxLength(maxNameLength)
+	v.String("parentName", c.ParentName).Required().MaxLength(maxNameLength)
+	v.String("userId", c.UserId).Required()
+	return v.Err()
 }
 
 func (c ItemCategory) checkName() error {
-	if strings.TrimSpace(c.Name) == "" {
-		return errors.New("Category Name field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("name", c.Name).Required()
+	return v.Err()
 }
 
 type Brand struct {
@@ -130,13 +232,10 @@ func createBrand(userId string) Brand {
 }
 
 func (b Brand) checkFields() error {
-	if strings.TrimSpace(b.Name) == "" {
-		return errors.New("Brand Name field can't be empty.")
-	}
-	if strings.TrimSpace(b.UserId) == "" {
-		return errors.New("User Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("name", b.Name).Required().MaxLength(maxNameLength)
+	v.String("userId", b.UserId).Required()
+	return v.Err()
 }
 
 type Size struct {
@@ -150,13 +249,10 @@ type Sizes struct {
 }
 
 func (s Size) checkFields() error {
-	if strings.TrimSpace(s.Name) == "" {
-		return errors.New("Size Name field can't be empty.")
-	}
-	if strings.TrimSpace(s.UserId) == "" {
-		return errors.New("User Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("name", s.Name).Required().MaxLength(maxNameLength)
+	v.String("userId", s.UserId).Required()
+	return v.Err()
 }
 
 func (s *Size) setUserId(userId string) {
@@ -167,10 +263,9 @@ func (s *Size) setId(id int) {
 }
 
 func (s Size) checkName() error {
-	if strings.TrimSpace(s.Name) == "" {
-		return errors.New("Size Name field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("name", s.Name).Required()
+	return v.Err()
 }
 
 type Location struct {
@@ -184,20 +279,16 @@ type Locations struct {
 }
 
 func (loc Location) checkFields() error {
-	if strings.TrimSpace(loc.Address) == "" {
-		return errors.New("Address field can't be empty.")
-	}
-	if strings.TrimSpace(loc.UserId) == "" {
-		return errors.New("User Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("address", loc.Address).Required().MaxLength(maxAddressLength)
+	v.String("userId", loc.UserId).Required()
+	return v.Err()
 }
 
 func (loc Location) checkId() error {
-	if loc.Id == 0 {
-		return errors.New("Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.Int("id", loc.Id).Required()
+	return v.Err()
 }
 
 func (loc *Location) setUserId(userId string) {
@@ -220,19 +311,12 @@ type Discounts struct {
 }
 
 func (dis Discount) checkFields() error {
-	if strings.TrimSpace(dis.Code) == "" {
-		return errors.New("Code field can't be empty.")
-	}
-	if strings.TrimSpace(dis.Amount) == "" {
-		return errors.New("Amount field can't be empty.")
-	}
-	if dis.ExpiresAt == 0 {
-		return errors.New("ExpiresAt field can't be empty.")
-	}
-	if strings.TrimSpace(dis.UserId) == "" {
-		return errors.New("UserId field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.String("code", dis.Code).Required().MaxLength(maxDiscountCodeLength)
+	v.String("amount", dis.Amount).Required().Matches(discountAmountRegex)
+	v.Int("expiresAt", dis.ExpiresAt).Required().Future()
+	v.String("userId", dis.UserId).Required()
+	return v.Err()
 }
 
 func (dis *Discount) setUserId(userId string) {
@@ -243,10 +327,9 @@ func (dis *Discount) setId(id int) {
 }
 
 func (dis Discount) checkId() error {
-	if dis.Id == 0 {
-		return errors.New("Id field can't be empty.")
-	}
-	return nil
+	v := validation.New()
+	v.Int("id", dis.Id).Required()
+	return v.Err()
 }
 
 type ItemDiscount struct {
@@ -259,15 +342,10 @@ type ItemDiscounts struct {
 	ItemDiscountsArr []ItemDiscount `json:"itemdiscounts,omitempty"`
 }
 
-func (i *ItemDiscount) checkFields() error {
-	if strings.TrimSpace(i.ItemId) == "" {
-		return errors.New("ItemId field can't be empty.")
-	}
-	if strings.TrimSpace(i.DiscountId) == "" {
-		return errors.New("DiscountId field can't be empty.")
-	}
-	if i.ValidAt == 0 {
-		return errors.New("ValidAt field can't be empty.")
-	}
-	return nil
+func (i *ItemDiscount) checkFields(ctx context.Context, s Service) error {
+	v := validation.New()
+	v.String("itemId", i.ItemId).Required().Exists(func() (bool, error) { return s.ItemExists(ctx, i.ItemId) })
+	v.String("discountId", i.DiscountId).Required().Exists(func() (bool, error) { return s.DiscountExists(ctx, i.DiscountId) })
+	v.Int("validAt", i.ValidAt).Required()
+	return v.Err()
 }
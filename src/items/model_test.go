@@ -0,0 +1,57 @@
+package items
+
+import (
+	"context"
+	"testing"
+)
+
+func TestItemDocumentDiscountedPrice(t *testing.T) {
+	current := ItemDocument{Id: 1, CategoryId: 1, Price: 100}
+	for discountedPrice, valid := range map[int]bool{1: true, 99: true, 0: false, 100: false, 150: false} {
+		item := current
+		item.DiscountedPrice = &discountedPrice
+		if err := item.checkFields(context.Background(), nil, current); (err == nil) != valid {
+			t.Errorf("discounted price %d: %v", discountedPrice, err)
+		}
+	}
+}
+
+func TestItemDocumentWithoutPrice(t *testing.T) {
+	current := ItemDocument{Id: 1, CategoryId: 1, Price: 100}
+	discountedPrice := 50
+	item := ItemDocument{Id: 1, CategoryId: 1, Price: 0, DiscountedPrice: &discountedPrice}
+	if err := item.checkFields(context.Background(), nil, current); err == nil {
+		t.Error("discounted price of an item without a price was accepted")
+	}
+	item.DiscountedPrice = nil
+	if err := item.checkFields(context.Background(), nil, current); err != nil {
+		t.Errorf("item without a price: %v", err)
+	}
+}
+
+func TestItemPatchPrices(t *testing.T) {
+	discountedPrice := 80
+	current := ItemDocument{Id: 1, CategoryId: 1, Price: 100, DiscountedPrice: &discountedPrice}
+	tests := []struct {
+		name  string
+		patch ItemPatch
+		valid bool
+	}{
+		{"discounted price below the current price", ItemPatch{DiscountedPrice: 90}, true},
+		{"discounted price above the current price", ItemPatch{DiscountedPrice: 150}, false},
+		{"discounted price below the new price", ItemPatch{Price: 200, DiscountedPrice: 150}, true},
+		{"discounted price above the new price", ItemPatch{Price: 60, DiscountedPrice: 70}, false},
+		{"price above the current discounted price", ItemPatch{Price: 90}, true},
+		{"price below the current discounted price", ItemPatch{Price: 70}, false},
+		{"price below the cleared discounted price", ItemPatch{Price: 70, Discount: true}, true},
+	}
+	for _, test := range tests {
+		test.patch.Id, test.patch.ModifiedAt = 1, 1
+		if err := test.patch.checkFields(context.Background(), nil, current); (err == nil) != test.valid {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	if err := (ItemPatch{Id: 1, ModifiedAt: 1, DiscountedPrice: 10}).checkFields(context.Background(), nil, ItemDocument{Id: 1, CategoryId: 1}); err == nil {
+		t.Error("discounted price of an item without a price was accepted")
+	}
+}
@@ -1,26 +1,32 @@
 package items
 
 import (
+	"time"
+
 	M "github.com/fnmzgdt/e_shop/src/middleware"
 	"github.com/go-chi/chi"
 )
 
 func PostsRoutes(s Service, m M.Controller) *chi.Mux {
+	readLimit := M.NewRateLimitPolicy("items-read", 120, time.Minute)
+	writeLimit := M.NewRateLimitPolicy("items-write", 30, time.Minute)
+	readTimeout := M.NewTimeoutPolicy("items-read", 2*time.Second)
+	writeTimeout := M.NewTimeoutPolicy("items-write", 5*time.Second)
 	router := chi.NewRouter()
-	router.With(m.CheckMethod("POST"), m.Authorize(), m.StaffAuthorize(), m.AddHeader("Content-Type", "application/json")).Post("/items", postItem(s))
-	router.With(m.Authorize()).Post("/category", postCategory(s))
-	router.With().Delete("/category", deleteCategory(s))
-	router.With().Post("/brand", postBrand(s))
-	router.With().Post("/size", postSizes(s))
-	router.With().Delete("/size", deleteSizes(s))
-	router.With().Post("/location", postLocations(s))
-	router.With().Delete("/location", deleteLocations(s))
-	router.With().Post("/discount", postDiscounts(s))
-	router.With().Delete("/discount", deleteDiscounts(s))
-	router.With().Post("/applydiscount", applyDiscounts(s))
-	router.Patch("/items/{id}", updateItem(s))
-	router.Delete("/items/{id}", deleteItem(s))
-	router.Get("/items/{id}", getItem(s))
-	router.Get("/items", getItems(s))
+	router.With(m.CheckMethod("POST"), m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.ItemsWrite), m.AddHeader("Content-Type", "application/json")).Post("/items", postItem(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.CatalogManage)).Post("/category", postCategory(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.CatalogManage)).Delete("/category", deleteCategory(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.CatalogManage)).Post("/brand", postBrand(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.CatalogManage)).Post("/size", postSizes(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.CatalogManage)).Delete("/size", deleteSizes(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.LocationsManage)).Post("/location", postLocations(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.LocationsManage)).Delete("/location", deleteLocations(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.DiscountsManage)).Post("/discount", postDiscounts(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.DiscountsManage)).Delete("/discount", deleteDiscounts(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.DiscountsManage)).Post("/applydiscount", applyDiscounts(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.ItemsWrite)).Patch("/items/{id}", updateItem(s))
+	router.With(m.RateLimit(writeLimit), m.Timeout(writeTimeout), m.RequirePermission(M.ItemsDelete)).Delete("/items/{id}", deleteItem(s))
+	router.With(m.RateLimit(readLimit), m.Timeout(readTimeout)).Get("/items/{id}", getItem(s))
+	router.With(m.RateLimit(readLimit), m.Timeout(readTimeout)).Get("/items", getItems(s))
 	return router
 }
@@ -1,237 +1,181 @@
 package items
 
 import (
-	"database/sql"
-	"strings"
+	"context"
+	"errors"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
 )
 
 type Service interface {
-	InsertItem(post *ItemPost) (int, error)
-	GetItem(itemId int) (*ItemGet, error)
-	GetItems(limit int) (*[]ItemGet, error)
-	UpdateItem(item *ItemPatch) (int, error)
-	DeleteItem(itemId int) (int, error)
-	InsertCategory(category *ItemCategory) (int64, error)
-	DeleteCategory(category *ItemCategory) error
-	InsertBrand(brand *Brand) (int64, error)
-	InsertSize(size *Size) (int, error)
-	DeleteSize(size *Size) error
-	InsertLocation(location *Location) (int, error)
-	DeleteLocation(location *Location) error
-	InsertDiscount(dis *Discount) (int, error)
-	DeleteDiscount(dis *Discount) error
-	InsertItemDiscount(itemdis *ItemDiscount) error
-}
-
+	InsertItem(ctx context.Context, post *ItemPost) (int, error)
+	GetItem(ctx context.Context, itemId int) (*ItemGet, error)
+	GetItems(ctx context.Context, limit int) (*[]ItemGet, error)
+	UpdateItem(ctx context.Context, item *ItemPatch) (int, error)
+	GetItemDocument(ctx context.Context, itemId int) (*ItemDocument, error)
+	PatchItem(ctx context.Context, current *ItemDocument, patched *ItemDocument, modifiedAt int) (int, error)
+	DeleteItem(ctx context.Context, itemId int, version int) (int, error)
+	InsertCategory(ctx context.Context, category *ItemCategory) (int64, error)
+	DeleteCategory(ctx context.Context, category *ItemCategory) error
+	InsertBrand(ctx context.Context, brand *Brand) (int64, error)
+	InsertSizes(ctx context.Context, sizes []Size) error
+	DeleteSizes(ctx context.Context, sizes []Size) error
+	InsertLocations(ctx context.Context, locations []Location) error
+	DeleteLocations(ctx context.Context, locations []Location) error
+	InsertDiscounts(ctx context.Context, discounts []Discount) error
+	DeleteDiscounts(ctx context.Context, discounts []Discount) error
+	InsertItemDiscounts(ctx context.Context, itemdiscounts []ItemDiscount) error
+	CategoryExists(ctx context.Context, categoryId int) (bool, error)
+	BrandExists(ctx context.Context, brandId int) (bool, error)
+	ItemExists(ctx context.Context, itemId string) (bool, error)
+	DiscountExists(ctx context.Context, discountId string) (bool, error)
+}
+
+var ErrItemModified = apperrors.PreconditionFailed("item_modified", "The item was changed by someone else. Reload it and try again.")
+
+//The multi-row writes are all-or-nothing only inside InTransaction.
 type Rdbms interface {
-	ExecuteQuery(query string, values ...interface{}) (sql.Result, error)
-	GetItem(query string, id int) (*ItemGet, error)
-	GetItems(query string, limit int) (*[]ItemGet, error)
+	InsertItem(ctx context.Context, item *ItemPost) (int, error)
+	GetItem(ctx context.Context, id int) (*ItemGet, error)
+	GetItems(ctx context.Context, limit int) (*[]ItemGet, error)
+	UpdateItem(ctx context.Context, item *ItemPatch) (int64, error)
+	GetItemDocument(ctx context.Context, id int) (*ItemDocument, error)
+	PatchItem(ctx context.Context, current *ItemDocument, patched *ItemDocument, modifiedAt int) (int64, error)
+	DeleteItem(ctx context.Context, id int, version int) (int64, error)
+	InsertCategory(ctx context.Context, category *ItemCategory) (int64, error)
+	DeleteCategory(ctx context.Context, name string) error
+	InsertBrand(ctx context.Context, brand *Brand) (int64, error)
+	InsertSizes(ctx context.Context, sizes []Size) error
+	DeleteSizes(ctx context.Context, sizes []Size) error
+	InsertLocations(ctx context.Context, locations []Location) error
+	DeleteLocations(ctx context.Context, locations []Location) error
+	InsertDiscounts(ctx context.Context, discounts []Discount) error
+	DeleteDiscounts(ctx context.Context, discounts []Discount) error
+	InsertItemDiscounts(ctx context.Context, itemdiscounts []ItemDiscount) error
+	CategoryExists(ctx context.Context, categoryId int) (bool, error)
+	BrandExists(ctx context.Context, brandId int) (bool, error)
+	ItemExists(ctx context.Context, itemId string) (bool, error)
+	DiscountExists(ctx context.Context, discountId string) (bool, error)
+	InTransaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type service struct {
-	mysql Rdbms
+	rdbms Rdbms
 }
 
 func NewPostsService(db Rdbms) Service {
 	return &service{db}
 }
 
-func (s *service) InsertItem(item *ItemPost) (int, error) {
-	query := "INSERT INTO items(user_id, category_id, brand_id, created_at, price, discounted_price, description) VALUES (?, ?, ?, FROM_UNIXTIME(?), ?, ?, ?)"
-	res, err := s.mysql.ExecuteQuery(query, item.UserId, item.CategoryId, item.BrandId, item.CreatedAt, item.Price, item.DiscountedPrice, item.Description)
-	if err != nil {
-		return 0, err
-	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return int(id), nil
+func (s *service) InsertItem(ctx context.Context, item *ItemPost) (int, error) {
+	return s.rdbms.InsertItem(ctx, item)
 }
 
-func (s *service) GetItem(itemId int) (*ItemGet, error) {
-	query := "SELECT id, user_id, category_id, brand_id, UNIX_TIMESTAMP(created_at), price, discounted_price, description, UNIX_TIMESTAMP(modified_at) FROM items WHERE id = (?) AND deleted_at IS NULL;"
-	item, err := s.mysql.GetItem(query, itemId)
+func (s *service) GetItem(ctx context.Context, itemId int) (*ItemGet, error) {
+	item, err := s.rdbms.GetItem(ctx, itemId)
 	if err != nil {
-		return nil, err
+		return nil, itemNotFoundError(err)
 	}
 	return item, nil
 }
 
-func (s *service) GetItems(limit int) (*[]ItemGet, error) {
-	query := "SELECT id, user_id, category_id, brand_id, UNIX_TIMESTAMP(created_at), price, discounted_price, description, UNIX_TIMESTAMP(modified_at) FROM items WHERE deleted_at IS NULL LIMIT ?;"
-	items, err := s.mysql.GetItems(query, limit)
-	if err != nil {
-		return nil, err
+func itemNotFoundError(err error) error {
+	if errors.Is(err, apperrors.ErrNotFound) {
+		return apperrors.New(apperrors.ErrNotFound, "item_not_found", "Item not found", err)
 	}
-	return items, nil
+	return err
 }
 
-func (s *service) UpdateItem(item *ItemPatch) (int, error) {
-	var params []interface{}
-	query := "UPDATE items SET"
-	if item.CategoryId != 0 {
-		query += " category_id = (?),"
-		params = append(params, item.CategoryId)
-	}
-	if item.BrandId != 0 {
-		query += " brand_id = (?),"
-		params = append(params, item.BrandId)
-	}
-	if item.Price != 0 {
-		query += " price = (?),"
-		params = append(params, item.Price)
-	}
-	if item.Discount { //when discounted is true and discountedPrice = 0 / null : set it to null
-		query += " discounted_price = NULLIF(?, 0),"
-		params = append(params, item.DiscountedPrice)
-	}
-	if item.Description != "" {
-		query += " description = (?),"
-		params = append(params, item.Description)
-	}
-	if item.ModifiedAt != 0 {
-		query += " modified_at = FROM_UNIXTIME(?),"
-		params = append(params, item.ModifiedAt)
-	}
-	if item.ChangeDeleted {
-		query += " deleted_at = FROM_UNIXTIME(NULLIF(?, 0)),"
-		params = append(params, item.DeletedAt)
-	}
-	query = strings.TrimSuffix(query, ",")
-	query += " WHERE id = (?);"
-	params = append(params, item.Id)
-	res, err := s.mysql.ExecuteQuery(query, params...)
+func (s *service) GetItems(ctx context.Context, limit int) (*[]ItemGet, error) {
+	return s.rdbms.GetItems(ctx, limit)
+}
+
+func (s *service) UpdateItem(ctx context.Context, item *ItemPatch) (int, error) {
+	return checkVersion(s.rdbms.UpdateItem(ctx, item))
+}
+
+//Deleted items are included, so a patch can restore them.
+func (s *service) GetItemDocument(ctx context.Context, itemId int) (*ItemDocument, error) {
+	item, err := s.rdbms.GetItemDocument(ctx, itemId)
 	if err != nil {
-		return 0, err
+		return nil, itemNotFoundError(err)
 	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, err
+	return item, nil
+}
+
+func (s *service) PatchItem(ctx context.Context, current *ItemDocument, patched *ItemDocument, modifiedAt int) (int, error) {
+	if patched.sameAs(*current) {
+		return 0, nil
 	}
-	return int(rowsAffected), nil
+	return checkVersion(s.rdbms.PatchItem(ctx, current, patched, modifiedAt))
 }
 
-func (s *service) DeleteItem(itemId int) (int, error) {
-	query := "DELETE FROM items WHERE id = (?);"
-	res, err := s.mysql.ExecuteQuery(query, itemId)
+func checkVersion(rowsAffected int64, err error) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, err
+	if rowsAffected == 0 {
+		return 0, ErrItemModified
 	}
 	return int(rowsAffected), nil
 }
 
-func (s *service) InsertCategory(category *ItemCategory) (int64, error) {
-	query := "call shop.add_subcategory(?, ?, ?);"
-	res, err := s.mysql.ExecuteQuery(query, category.Name, category.ParentName, category.UserId)
-	if err != nil {
-		return 0, err
-	}
-	lastId, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return lastId, nil
+func (s *service) DeleteItem(ctx context.Context, itemId int, version int) (int, error) {
+	return checkVersion(s.rdbms.DeleteItem(ctx, itemId, version))
 }
 
-func (s *service) DeleteCategory(category *ItemCategory) error {
-	query := "call shop.delete_category(?);"
-	_, err := s.mysql.ExecuteQuery(query, category.Name)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *service) InsertCategory(ctx context.Context, category *ItemCategory) (int64, error) {
+	return s.rdbms.InsertCategory(ctx, category)
 }
 
-func (s *service) InsertBrand(brand *Brand) (int64, error) {
-	query := "INSERT INTO brands(name, user_id) VALUES(?, ?);"
-	res, err := s.mysql.ExecuteQuery(query, brand.Name, brand.UserId)
-	if err != nil {
-		return 0, err
-	}
-	lastId, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return lastId, nil
+func (s *service) DeleteCategory(ctx context.Context, category *ItemCategory) error {
+	return s.rdbms.DeleteCategory(ctx, category.Name)
 }
 
-func (s *service) InsertSize(size *Size) (int, error) {
-	query := "INSERT INTO sizes(name, user_id) VALUES(?, ?);"
-	res, err := s.mysql.ExecuteQuery(query, size.Name, size.UserId)
-	if err != nil {
-		return 0, err
-	}
-	lastId, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return int(lastId), nil
+func (s *service) InsertBrand(ctx context.Context, brand *Brand) (int64, error) {
+	return s.rdbms.InsertBrand(ctx, brand)
 }
 
-func (s *service) DeleteSize(size *Size) error {
-	query := "DELETE FROM sizes WHERE name = ?;"
-	_, err := s.mysql.ExecuteQuery(query, size.Name)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *service) InsertSizes(ctx context.Context, sizes []Size) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.InsertSizes(ctx, sizes) })
 }
 
-func (s *service) InsertLocation(location *Location) (int, error) {
-	query := "INSERT INTO locations(address, user_id) VALUES(?, ?);"
-	res, err := s.mysql.ExecuteQuery(query, location.Address, location.UserId)
-	if err != nil {
-		return 0, err
-	}
-	lastId, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return int(lastId), nil
+func (s *service) DeleteSizes(ctx context.Context, sizes []Size) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.DeleteSizes(ctx, sizes) })
 }
 
-func (s *service) DeleteLocation(location *Location) error {
-	query := "DELETE FROM locations WHERE id = (?);"
-	_, err := s.mysql.ExecuteQuery(query, location.Id)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *service) InsertLocations(ctx context.Context, locations []Location) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.InsertLocations(ctx, locations) })
 }
 
-func (s *service) InsertDiscount(dis *Discount) (int, error) {
-	query := "INSERT INTO discounts(code, amount, expires_at, user_id) VALUES(?, ?, FROM_UNIXTIME(?), ?);"
-	res, err := s.mysql.ExecuteQuery(query, dis.Code, dis.Amount, dis.ExpiresAt, dis.UserId)
-	if err != nil {
-		return 0, err
-	}
-	lastId, err := res.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
-	return int(lastId), nil
+func (s *service) DeleteLocations(ctx context.Context, locations []Location) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.DeleteLocations(ctx, locations) })
 }
 
-func (s *service) DeleteDiscount(dis *Discount) error {
-	query := "DELETE FROM discounts WHERE id = (?);"
-	_, err := s.mysql.ExecuteQuery(query, dis.Id)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *service) InsertDiscounts(ctx context.Context, discounts []Discount) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.InsertDiscounts(ctx, discounts) })
 }
 
-func (s *service) InsertItemDiscount(itemdis *ItemDiscount) error {
-	query := "INSERT INTO items_discounts(item_id, discount_id, valid_at) VALUES(?, ?, FROM_UNIXTIME(?));"
-	_, err := s.mysql.ExecuteQuery(query, itemdis.ItemId, itemdis.DiscountId, itemdis.ValidAt)
-	if err != nil {
-		return err
-	}
-	return nil
+func (s *service) DeleteDiscounts(ctx context.Context, discounts []Discount) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.DeleteDiscounts(ctx, discounts) })
+}
+
+func (s *service) InsertItemDiscounts(ctx context.Context, itemdiscounts []ItemDiscount) error {
+	return s.rdbms.InTransaction(ctx, func(ctx context.Context) error { return s.rdbms.InsertItemDiscounts(ctx, itemdiscounts) })
+}
+
+func (s *service) CategoryExists(ctx context.Context, categoryId int) (bool, error) {
+	return s.rdbms.CategoryExists(ctx, categoryId)
+}
+
+func (s *service) BrandExists(ctx context.Context, brandId int) (bool, error) {
+	return s.rdbms.BrandExists(ctx, brandId)
+}
+
+func (s *service) ItemExists(ctx context.Context, itemId string) (bool, error) {
+	return s.rdbms.ItemExists(ctx, itemId)
+}
+
+func (s *service) DiscountExists(ctx context.Context, discountId string) (bool, error) {
+	return s.rdbms.DiscountExists(ctx, discountId)
 }
@@ -0,0 +1,152 @@
+package items_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/items"
+	"github.com/fnmzgdt/e_shop/src/repositories"
+	_ "modernc.org/sqlite"
+)
+
+func newTestService(t *testing.T) items.Service {
+	t.Helper()
+	t.Setenv("SQLITE_PATH", ":memory:")
+	db, err := repositories.SetupSQLiteConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.InsertUser(context.Background(), "owner@example.com", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	return items.NewPostsService(db)
+}
+
+func insertTestItem(t *testing.T, s items.Service) int {
+	t.Helper()
+	ctx := context.Background()
+	brandId, err := s.InsertBrand(ctx, &items.Brand{Name: "brand", UserId: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.InsertItem(ctx, &items.ItemPost{UserId: 1, CategoryId: 1, BrandId: int(brandId), CreatedAt: 1600000000, Price: 100, Description: "shoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func errorCode(err error) string {
+	var appErr *apperrors.Error
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+	return ""
+}
+
+func TestGetMissingItem(t *testing.T) {
+	s := newTestService(t)
+	if _, err := s.GetItem(context.Background(), 1); errorCode(err) != "item_not_found" {
+		t.Errorf("get of a missing item: %v", err)
+	}
+	if _, err := s.GetItemDocument(context.Background(), 1); errorCode(err) != "item_not_found" {
+		t.Errorf("document of a missing item: %v", err)
+	}
+}
+
+func TestPatchItem(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	id := insertTestItem(t, s)
+	current, err := s.GetItemDocument(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := *current
+	if n, err := s.PatchItem(ctx, current, &unchanged, 1700000000); err != nil || n != 0 {
+		t.Errorf("patch without changes updated %d rows: %v", n, err)
+	}
+
+	patched := *current
+	patched.Description = "boot"
+	if n, err := s.PatchItem(ctx, current, &patched, 1700000000); err != nil || n != 1 {
+		t.Fatalf("patch updated %d rows: %v", n, err)
+	}
+	if _, err := s.PatchItem(ctx, current, &patched, 1700000000); !errors.Is(err, items.ErrItemModified) {
+		t.Errorf("patch of a stale version: %v", err)
+	}
+	item, err := s.GetItem(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Description != "boot" || item.Version != current.Version+1 {
+		t.Errorf("patched item %+v", *item)
+	}
+}
+
+func TestUpdateAndDeleteCheckTheVersion(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	id := insertTestItem(t, s)
+	if _, err := s.UpdateItem(ctx, &items.ItemPatch{Id: id, Price: 80, ModifiedAt: 1700000000, Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateItem(ctx, &items.ItemPatch{Id: id, Price: 70, ModifiedAt: 1700000000, Version: 1}); !errors.Is(err, apperrors.ErrPreconditionFailed) {
+		t.Errorf("update of a stale version: %v", err)
+	}
+	if _, err := s.DeleteItem(ctx, id, 1); !errors.Is(err, items.ErrItemModified) {
+		t.Errorf("delete of a stale version: %v", err)
+	}
+	if n, err := s.DeleteItem(ctx, id, 2); err != nil || n != 1 {
+		t.Errorf("delete deleted %d rows: %v", n, err)
+	}
+}
+
+func TestBatchesAreAllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	sizes := []items.Size{{Name: "s", UserId: "1"}, {Name: "m", UserId: "1"}}
+	if err := s.InsertSizes(ctx, sizes); err != nil {
+		t.Fatal(err)
+	}
+	if sizes[0].Id == 0 || sizes[1].Id == sizes[0].Id {
+		t.Errorf("size ids %+v", sizes)
+	}
+	if err := s.InsertSizes(ctx, []items.Size{{Name: "l", UserId: "1"}, {Name: "s", UserId: "1"}}); !errors.Is(err, apperrors.ErrConflict) {
+		t.Fatalf("insert of a duplicate size: %v", err)
+	}
+	if err := s.InsertSizes(ctx, []items.Size{{Name: "l", UserId: "1"}}); err != nil {
+		t.Errorf("the size of the failed batch was inserted: %v", err)
+	}
+
+	locations := []items.Location{{Address: "1 Main St", UserId: "1"}, {Address: "2 Main St", UserId: "1"}}
+	if err := s.InsertLocations(ctx, locations); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteLocations(ctx, locations); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertLocations(ctx, locations[:1]); err != nil || locations[0].Id != 3 {
+		t.Errorf("location id %d: %v", locations[0].Id, err)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "shoes", ParentName: "missing", UserId: "1"}); !errors.Is(err, apperrors.ErrValidation) {
+		t.Errorf("insert under a missing parent: %v", err)
+	}
+	if err := s.DeleteCategory(ctx, &items.ItemCategory{Name: "all"}); !errors.Is(err, apperrors.ErrConflict) {
+		t.Errorf("delete of the root: %v", err)
+	}
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "shoes", ParentName: "all", UserId: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCategory(ctx, &items.ItemCategory{Name: "shoes"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+type smtpMailer struct {
+	host string
+	port string
+	from string
+	auth smtp.Auth
+}
+
+type logMailer struct{}
+
+func SetupMailer() Mailer {
+	var (
+		host     = utils.GetEnv("SMTP_HOST", "")
+		port     = utils.GetEnv("SMTP_PORT", "587")
+		user     = utils.GetEnv("SMTP_USER", "")
+		password = utils.GetEnv("SMTP_PASSWORD", "")
+		from     = utils.GetEnv("SMTP_FROM", "no-reply@localhost")
+	)
+	if host == "" {
+		fmt.Println("SMTP_HOST is not set, mails will not be sent; only their recipients and subjects are printed.")
+		return &logMailer{}
+	}
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &smtpMailer{host: host, port: port, from: from, auth: auth}
+}
+
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("send mail: invalid header value")
+	}
+	message := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.host+":"+m.port, m.auth, m.from, []string{to}, []byte(message))
+}
+
+//Bodies are left out because they carry secrets such as unlock tokens.
+func (m *logMailer) Send(to string, subject string, body string) error {
+	fmt.Printf("Mail to %s: %s\n", to, subject)
+	return nil
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+//API keys look like esk_<prefix>_<secret>. The prefix is stored in plain text to find the key and to tell keys apart; only a hash of the whole key is stored.
+const apiKeyScheme = "esk_"
+
+var ErrInvalidAPIKey = apperrors.Unauthorized("invalid_api_key", "Invalid API key")
+
+//The last used time of a key is written at most this often, so a busy integration doesn't cause a write per request.
+const lastUsedResolution = time.Minute
+
+type APIKeyCredentials struct {
+	Id          string
+	UserId      string
+	Email       string
+	KeyHash     string
+	Permissions string
+	AllowedIPs  string
+	ExpiresAt   int64
+	Revoked     bool
+}
+
+func NewAPIKey() (string, string, string, error) {
+	random := make([]byte, 30)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(random)
+	prefix := strings.NewReplacer("-", "a", "_", "b").Replace(encoded[:8])
+	key := apiKeyScheme + prefix + "_" + encoded[8:]
+	return key, prefix, HashAPIKey(key), nil
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyScheme) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyScheme), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	for _, scheme := range []string{"ApiKey ", "Bearer "} {
+		if len(authorization) > len(scheme) && strings.EqualFold(authorization[:len(scheme)], scheme) {
+			key := strings.TrimSpace(authorization[len(scheme):])
+			return key, strings.HasPrefix(key, apiKeyScheme)
+		}
+	}
+	return "", false
+}
+
+func ipAllowed(allowedIPs string, ip string) bool {
+	if strings.TrimSpace(allowedIPs) == "" {
+		return true
+	}
+	clientIP := net.ParseIP(ip)
+	if clientIP == nil {
+		return false
+	}
+	for _, allowed := range strings.Split(allowedIPs, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(clientIP) {
+				return true
+			}
+			continue
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+//The principal has the roles of the key's owner, but can only use the permissions the key was scoped to.
+func (s *service) AuthenticateAPIKey(ctx context.Context, key string, ip string) (*Principal, error) {
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	credentials, err := s.rdbms.GetAPIKeyCredentials(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(credentials.KeyHash), []byte(HashAPIKey(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if credentials.Revoked || (credentials.ExpiresAt != 0 && time.Now().Unix() >= credentials.ExpiresAt) || !ipAllowed(credentials.AllowedIPs, ip) {
+		return nil, ErrInvalidAPIKey
+	}
+	roles, err := s.rdbms.GetRoles(ctx, credentials.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rdbms.TouchAPIKey(ctx, credentials.Id, lastUsedResolution); err != nil {
+		return nil, err
+	}
+	//A key is no second factor: roles in MFA_REQUIRED_ROLES don't count for its requests, including roles granted to the owner after the key was created.
+	return &Principal{UserId: credentials.UserId, Email: credentials.Email, Roles: roles, MFA: false, APIKeyId: credentials.Id, Scopes: strings.Split(credentials.Permissions, ",")}, nil
+}
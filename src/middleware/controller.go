@@ -1,101 +1,184 @@
 package middleware
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/fnmzgdt/e_shop/src/apperrors"
 	"github.com/fnmzgdt/e_shop/src/responses"
+	"github.com/fnmzgdt/e_shop/src/utils"
 )
 
 type Controller interface {
 	Serialize(http.Handler) http.Handler
 	Authorize() Adapter
 	GetAccessToken(w http.ResponseWriter, r *http.Request)
+	GetJWKS(w http.ResponseWriter, r *http.Request)
 	AddHeader(key, value string) Adapter
 	CheckMethod(method string) Adapter
 	StaffAuthorize() Adapter
+	RequirePermission(permission string) Adapter
+	CSRFProtect() Adapter
+	CORS(policy *CORSPolicy, overrides ...CORSOverride) Adapter
+	RateLimit(policy *RateLimitPolicy) Adapter
+	Timeout(policy *TimeoutPolicy) Adapter
 }
 
 type middlewareController struct {
-	service Service
+	service            Service
+	rateLimits         RateLimitStore
+	fallbackRateLimits RateLimitStore
+	rateLimitErrorAt   int64
 }
 
-func NewMIddlewareController(a InMemoryDb) Controller {
-	return &middlewareController{service: &service{redis: a}}
+//Rate limits are kept in c, or only in memory when c is nil.
+func NewMIddlewareController(a InMemoryDb, b Rdbms, c RateLimitStore) Controller {
+	fallback := NewMemoryRateLimitStore()
+	if c == nil {
+		c = fallback
+	}
+	return &middlewareController{service: &service{redis: a, rdbms: b}, rateLimits: c, fallbackRateLimits: fallback}
 }
 
 type Adapter func(http.Handler) http.Handler
 
+//The error codes of GetAccessToken. Clients should send the user to the login page for all of them.
+const (
+	RefreshMissing = "refresh_missing"
+	RefreshExpired = "refresh_expired"
+	RefreshInvalid = "refresh_invalid"
+	SessionRevoked = "session_revoked"
+)
+
 func (c *middlewareController) GetAccessToken(w http.ResponseWriter, r *http.Request) {
 	refreshCookie, err := r.Cookie("refreshToken")
-	if err != nil {
-		fmt.Println(err)
-		http.Redirect(w, r, "http://google.com", 302)
+	if err != nil || refreshCookie.Value == "" {
+		refreshFailed(w, r, RefreshMissing, "No refresh token was sent.")
 		return
 	}
-	refreshJwt := refreshCookie.Value
-	payload, err := Validate(refreshJwt)
+	payload, err := Validate(refreshCookie.Value)
 	if err != nil {
 		if err.Error() == "validate: Token is expired" {
-			http.Redirect(w, r, "http://google.com", 302)
+			refreshFailed(w, r, RefreshExpired, "The refresh token has expired.")
 			return
 		}
-		responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		refreshFailed(w, r, RefreshInvalid, "The refresh token is not valid.")
 		return
 	}
-	sessionId := payload.(map[string]interface{})["sessionId"].(string)
-	userId := payload.(map[string]interface{})["userId"].(string)
-	claims, err := c.service.GetSession(userId, sessionId)
+	data, _ := payload.(map[string]interface{})
+	sessionId, _ := data["sessionId"].(string)
+	userId, _ := data["userId"].(string)
+	if sessionId == "" || userId == "" {
+		refreshFailed(w, r, RefreshInvalid, "The refresh token is not valid.")
+		return
+	}
+	claims, err := c.service.GetSession(r.Context(), userId, sessionId)
 	if err != nil {
-		if err.Error() == "redis: nil" {
-			http.Redirect(w, r, "http://google.com", 302)
-			//delete cookie
+		if errors.Is(err, apperrors.ErrNotFound) {
+			refreshFailed(w, r, SessionRevoked, "The session has ended or was revoked.")
 			return
-		} else {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		}
+		responses.Error(w, r, err)
+		return
+	}
+	if claims.UserId != userId {
+		refreshFailed(w, r, SessionRevoked, "The session has ended or was revoked.")
+		return
+	}
+	tokenId, _ := data["tokenId"].(string)
+	refreshToken, newTokenId, err := NewRefreshToken(userId, sessionId)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if err := c.service.RotateRefreshToken(r.Context(), userId, sessionId, tokenId, newTokenId); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			refreshFailed(w, r, SessionRevoked, "Refresh token has already been used. The session has been revoked.")
 			return
 		}
+		responses.Error(w, r, err)
+		return
 	}
-	//check if session.userId == userId
-	accessToken, err := NewJWT(time.Minute*5, *claims)
+	accessToken, err := NewJWT(AccessTokenTTL, *claims)
 	if err != nil {
-		responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		responses.Error(w, r, err)
 		return
 	}
-	accessCookie := http.Cookie{Name: "accessToken", Value: accessToken, Path: "/", Expires: time.Now().Add(time.Minute * 5), Secure: true, HttpOnly: true}
+	rotatedCookie := http.Cookie{Name: "refreshToken", Value: refreshToken, Path: "/", Expires: time.Now().Add(RefreshTokenTTL), Secure: true, HttpOnly: true, SameSite: CookieSameSite()}
+	http.SetCookie(w, &rotatedCookie)
+	accessCookie := http.Cookie{Name: "accessToken", Value: accessToken, Path: "/", Expires: time.Now().Add(AccessTokenTTL), Secure: true, HttpOnly: true, SameSite: CookieSameSite()}
 	http.SetCookie(w, &accessCookie)
 	responses.JSONResponse(w, "Access token successfully renewed.", nil, 200)
 	return
 }
 
+func (c *middlewareController) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := json.Marshal(keySet.JWKS(time.Now()))
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jwks)
+	return
+}
+
 func (c *middlewareController) Serialize(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stripIdentityHeaders(r)
+		if key, ok := apiKeyFromRequest(r); ok {
+			principal, err := c.service.AuthenticateAPIKey(r.Context(), key, utils.ClientIP(r))
+			if err != nil {
+				responses.Error(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+			return
+		}
 		accessCookie, err := r.Cookie("accessToken")
 		if err != nil {
 			if err.Error() == "http: named cookie not present" {
 				next.ServeHTTP(w, r)
 				return
 			} else {
-				responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+				responses.Error(w, r, err)
 				return
 			}
 		}
-		payload, err := Validate(accessCookie.Value)
+		claims, err := ParseToken(accessCookie.Value)
 		if err != nil {
 			if err.Error() == "validate: Token is expired" {
 				next.ServeHTTP(w, r)
 				return
 			}
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
-		userId := payload.(map[string]interface{})["userId"].(string)
-		role := payload.(map[string]interface{})["role"].(string)
-
-		r.Header.Add("userId", userId)
-		r.Header.Add("role", role)
-		next.ServeHTTP(w, r)
+		data, _ := claims.Data.(map[string]interface{})
+		userId, _ := data["userId"].(string)
+		email, _ := data["email"].(string)
+		if userId == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		revoked, err := c.service.IsAccessTokenRevoked(r.Context(), userId, claims)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if revoked {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mfa, _ := data["mfa"].(bool)
+		principal := &Principal{UserId: userId, Email: email, Roles: rolesFromPayload(data), MFA: mfa, TokenId: claims.TokenId, ExpiresAt: claims.ExpiresAt}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
 		return
 	})
 }
@@ -103,8 +186,7 @@ func (c *middlewareController) Serialize(next http.Handler) http.Handler {
 func (c *middlewareController) Authorize() Adapter {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userId := r.Header.Get("userId")
-			if userId == "" {
+			if _, ok := PrincipalFromContext(r.Context()); !ok {
 				responses.JSONError(w, "Action requires authorization", http.StatusUnauthorized)
 				return
 			}
@@ -161,8 +243,8 @@ func (c *middlewareController) CheckMethod(method string) Adapter {
 func (c *middlewareController) StaffAuthorize() Adapter {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			role := r.Header.Get("role")
-			if role != "staff" {
+			principal, ok := PrincipalFromContext(r.Context())
+			if !ok || !principal.HasRole("staff") {
 				responses.JSONError(w, "Action requires special staff authorization", http.StatusUnauthorized)
 				return
 			}
@@ -171,3 +253,47 @@ func (c *middlewareController) StaffAuthorize() Adapter {
 		})
 	}
 }
+
+func (c *middlewareController) RequirePermission(permission string) Adapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				responses.JSONError(w, "Action requires authorization", http.StatusUnauthorized)
+				return
+			}
+			if !principal.HasPermission(permission) {
+				responses.JSONError(w, fmt.Sprintf("Action requires the %s permission", permission), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		})
+	}
+}
+
+//When AUTH_LOGIN_URL is set, browser navigations are redirected to the login page instead, since a person and not a script is waiting for the response.
+func refreshFailed(w http.ResponseWriter, r *http.Request, errorCode string, message string) {
+	ClearSessionCookies(w)
+	if loginURL := utils.GetEnv("AUTH_LOGIN_URL", ""); loginURL != "" && isBrowserNavigation(r) {
+		http.Redirect(w, r, loginURL, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, errorCode))
+	responses.JSONErrorCode(w, message, errorCode, http.StatusUnauthorized)
+}
+
+func isBrowserNavigation(r *http.Request) bool {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func ClearSessionCookies(w http.ResponseWriter) {
+	refreshCookie := http.Cookie{Name: "refreshToken", Value: "", Path: "/", Expires: time.Unix(0, 0), MaxAge: -1, Secure: true, HttpOnly: true, SameSite: CookieSameSite()}
+	http.SetCookie(w, &refreshCookie)
+
+	accessCookie := http.Cookie{Name: "accessToken", Value: "", Path: "/", Expires: time.Unix(0, 0), MaxAge: -1, Secure: true, HttpOnly: true, SameSite: CookieSameSite()}
+	http.SetCookie(w, &accessCookie)
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+//Allowed origins are exact ("https://shop.example.com"), a wildcard for the subdomains of a domain ("https://*.example.com") or "*" for any origin. Credentials are never allowed together with "*".
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+type CORSOverride struct {
+	PathPrefix string
+	Policy     *CORSPolicy
+}
+
+func NewCORSPolicy(prefix string, fallback *CORSPolicy) *CORSPolicy {
+	if fallback == nil {
+		fallback = &CORSPolicy{
+			AllowedOrigins:   []string{},
+			AllowedMethods:   []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowedHeaders:   []string{"Content-Type", "Authorization", CSRFHeaderName, "If-Match", "If-None-Match"},
+			ExposedHeaders:   []string{"ETag", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		}
+	}
+	return &CORSPolicy{
+		AllowedOrigins:   utils.GetEnvList(prefix+"_ALLOWED_ORIGINS", fallback.AllowedOrigins),
+		AllowedMethods:   utils.GetEnvList(prefix+"_ALLOWED_METHODS", fallback.AllowedMethods),
+		AllowedHeaders:   utils.GetEnvList(prefix+"_ALLOWED_HEADERS", fallback.AllowedHeaders),
+		ExposedHeaders:   utils.GetEnvList(prefix+"_EXPOSED_HEADERS", fallback.ExposedHeaders),
+		AllowCredentials: utils.GetEnvBool(prefix+"_ALLOW_CREDENTIALS", fallback.AllowCredentials),
+		MaxAge:           utils.GetEnvDuration(prefix+"_MAX_AGE", fallback.MaxAge),
+	}
+}
+
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	return containsFold(p.AllowedOrigins, "*")
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Scheme == "" || originURL.Host == "" {
+		return false
+	}
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		allowedURL, err := url.Parse(allowed)
+		if err != nil || !strings.HasPrefix(allowedURL.Host, "*.") || !strings.EqualFold(allowedURL.Scheme, originURL.Scheme) {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(originURL.Host), strings.ToLower(allowedURL.Host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.TrimSpace(header); header != "" && !containsFold(p.AllowedHeaders, header) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func corsPolicyFor(path string, policy *CORSPolicy, overrides []CORSOverride) *CORSPolicy {
+	matched := ""
+	for _, override := range overrides {
+		if strings.HasPrefix(path, override.PathPrefix) && len(override.PathPrefix) > len(matched) {
+			matched = override.PathPrefix
+			policy = override.Policy
+		}
+	}
+	return policy
+}
+
+//CORS has to run before the other adapters, so preflight requests are answered before authentication and error responses can be read by the frontend.
+func (c *middlewareController) CORS(policy *CORSPolicy, overrides ...CORSOverride) Adapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			policy := corsPolicyFor(r.URL.Path, policy, overrides)
+			headers := w.Header()
+			headers.Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				headers.Add("Vary", "Access-Control-Request-Method")
+				headers.Add("Vary", "Access-Control-Request-Headers")
+			}
+			if !policy.allowsOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if policy.allowsAnyOrigin() {
+				headers.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				headers.Set("Access-Control-Allow-Origin", origin)
+				if policy.AllowCredentials {
+					headers.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+			if !preflight {
+				if len(policy.ExposedHeaders) != 0 {
+					headers.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !containsFold(policy.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) || !policy.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				headers.Del("Access-Control-Allow-Origin")
+				headers.Del("Access-Control-Allow-Credentials")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			headers.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+			headers.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+			headers.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		})
+	}
+}
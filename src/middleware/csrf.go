@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/responses"
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+//CSRF protection uses the double submit pattern: the csrfToken cookie can be read by the frontend, which sends its value back in the X-CSRF-Token header. Another site can make the browser send the cookie but can't read it to set the header.
+const (
+	CSRFCookieName = "csrfToken"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+//COOKIE_SAMESITE=none is only needed when the frontend is served from another site.
+func CookieSameSite() http.SameSite {
+	switch strings.ToLower(utils.GetEnv("COOKIE_SAMESITE", "lax")) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+//A new CSRF token is issued when a session starts, so a token planted before the login can't be used.
+func SetCSRFCookie(w http.ResponseWriter) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	csrfCookie := http.Cookie{Name: CSRFCookieName, Value: token, Path: "/", Expires: time.Now().Add(RefreshTokenTTL), Secure: true, SameSite: CookieSameSite()}
+	http.SetCookie(w, &csrfCookie)
+	return token, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func hasSessionCookie(r *http.Request) bool {
+	for _, name := range []string{"accessToken", "refreshToken"} {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+//Requests authenticated with an API key are exempt, because the key is sent in a header the browser never adds on its own. Browsers without a token get one on their first request.
+func (c *middlewareController) CSRFProtect() Adapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := ""
+			if cookie, err := r.Cookie(CSRFCookieName); err == nil {
+				token = cookie.Value
+			}
+			if token == "" {
+				if _, err := SetCSRFCookie(w); err != nil {
+					responses.Error(w, r, err)
+					return
+				}
+			}
+			if isSafeMethod(r.Method) || !hasSessionCookie(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if principal, ok := PrincipalFromContext(r.Context()); ok && principal.APIKeyId != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			header := r.Header.Get(CSRFHeaderName)
+			if token == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+				responses.JSONError(w, "Missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		})
+	}
+}
@@ -1,38 +1,92 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"time"
 
-	"github.com/fnmzgdt/e_shop/src/utils"
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
 )
 
+const (
+	AccessTokenTTL  = time.Minute * 5
+	RefreshTokenTTL = time.Hour * 24 * 356
+)
+
+type TokenClaims struct {
+	Data      interface{}
+	TokenId   string
+	IssuedAt  time.Time
+	ExpiresAt int64
+}
+
+//Every refresh token gets a new id, which is returned so it can be stored as the only valid refresh token of the session.
+func NewRefreshToken(userId string, sessionId string) (string, string, error) {
+	tokenId := uuid.New().String()
+	token, err := NewJWT(RefreshTokenTTL, map[string]interface{}{"sessionId": sessionId, "userId": userId, "tokenId": tokenId})
+	if err != nil {
+		return "", "", err
+	}
+	return token, tokenId, nil
+}
+
 func NewJWT(ttl time.Duration, content interface{}) (string, error) {
-	privateKey := utils.GetEnv("JWT_SALT", "")
 	now := time.Now()
+	if keySet == nil {
+		return "", errors.New("create: no signing keys loaded")
+	}
+	key, err := keySet.signingKey(now)
+	if err != nil {
+		return "", fmt.Errorf("create: %w", err)
+	}
 
 	claims := make(jwt.MapClaims)
-	claims["data"] = content            // Our custom data.
-	claims["exp"] = now.Add(ttl).Unix() // The expiration time after which the token must be disregarded.
-	claims["iat"] = now.Unix()          // The time at which the token was issued.
+	claims["data"] = content                       // Our custom data.
+	claims["exp"] = now.Add(ttl).Unix()            // The expiration time after which the token must be disregarded.
+	claims["iat"] = float64(now.UnixMicro()) / 1e6 // The time at which the token was issued, to the microsecond.
+	claims["jti"] = uuid.New().String()            // The id the token can be revoked by.
 
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(privateKey))
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.alg), claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.private)
 	if err != nil {
 		return "", fmt.Errorf("create: sign token: %w", err)
 	}
-	return token, nil
+	return signed, nil
 }
 
 func Validate(token string) (interface{}, error) {
-	//jwt.ParseWithClaims()
+	claims, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Data, nil
+}
+
+func ParseToken(token string) (*TokenClaims, error) {
 	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(token, claims, func(jwtToken *jwt.Token) (interface{}, error) {
-		privateKey := utils.GetEnv("JWT_SALT", "")
-		return []byte(privateKey), nil
+	parser := jwt.Parser{ValidMethods: supportedAlgorithms}
+	_, err := parser.ParseWithClaims(token, claims, func(jwtToken *jwt.Token) (interface{}, error) {
+		if keySet == nil {
+			return nil, errors.New("no signing keys loaded")
+		}
+		kid, ok := jwtToken.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("token has no kid")
+		}
+		key, err := keySet.verificationKey(kid, jwtToken.Method.Alg(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return key.public, nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("validate: %w", err)
 	}
-	return claims["data"], nil
+	tokenId, _ := claims["jti"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+	return &TokenClaims{Data: claims["data"], TokenId: tokenId, IssuedAt: time.UnixMicro(int64(math.Round(issuedAt * 1e6))), ExpiresAt: int64(expiresAt)}, nil
 }
@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+var supportedAlgorithms = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+//Keys with only a public key file are accepted for verification but never used for signing, e.g. keys of another instance that is being retired.
+type keyConfig struct {
+	Kid            string    `json:"kid"`
+	Alg            string    `json:"alg"`
+	PrivateKeyFile string    `json:"privateKeyFile,omitempty"`
+	PublicKeyFile  string    `json:"publicKeyFile,omitempty"`
+	ActiveFrom     time.Time `json:"activeFrom"`
+}
+
+type signingKey struct {
+	kid        string
+	alg        string
+	activeFrom time.Time
+	private    crypto.PrivateKey
+	public     crypto.PublicKey
+}
+
+//A key keeps being accepted for the overlap window after its successor has been activated, so tokens it signed stay valid until they expire.
+type KeySet struct {
+	keys    []*signingKey
+	overlap time.Duration
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var keySet *KeySet
+
+func SetupKeySet() error {
+	path := utils.GetEnv("JWT_KEYS_FILE", "")
+	if path == "" {
+		return errors.New("setup keys: JWT_KEYS_FILE is not set; no key to sign tokens with")
+	}
+	overlap, err := time.ParseDuration(utils.GetEnv("JWT_KEY_OVERLAP", RefreshTokenTTL.String()))
+	if err != nil {
+		return fmt.Errorf("setup keys: JWT_KEY_OVERLAP: %w", err)
+	}
+	ks, err := LoadKeySet(path, overlap)
+	if err != nil {
+		return err
+	}
+	keySet = ks
+	return nil
+}
+
+func LoadKeySet(path string, overlap time.Duration) (*KeySet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("setup keys: %w", err)
+	}
+	var configs []keyConfig
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("setup keys: %s: %w", path, err)
+	}
+	ks := &KeySet{overlap: overlap}
+	kids := make(map[string]bool)
+	for _, config := range configs {
+		if config.Kid == "" {
+			return nil, errors.New("setup keys: every key needs a kid")
+		}
+		if kids[config.Kid] {
+			return nil, fmt.Errorf("setup keys: duplicate kid %s", config.Kid)
+		}
+		kids[config.Kid] = true
+		key, err := loadKey(config)
+		if err != nil {
+			return nil, fmt.Errorf("setup keys: %s: %w", config.Kid, err)
+		}
+		ks.keys = append(ks.keys, key)
+	}
+	sort.Slice(ks.keys, func(i, j int) bool { return ks.keys[i].activeFrom.Before(ks.keys[j].activeFrom) })
+	if _, err := ks.signingKey(time.Now()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func loadKey(config keyConfig) (*signingKey, error) {
+	key := &signingKey{kid: config.Kid, alg: config.Alg, activeFrom: config.ActiveFrom}
+	switch config.Alg {
+	case jwt.SigningMethodRS256.Alg():
+		if config.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(config.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			if private.N.BitLen() < 2048 {
+				return nil, errors.New("RSA keys must be at least 2048 bits long")
+			}
+			key.private, key.public = private, &private.PublicKey
+			return key, nil
+		}
+		pem, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		public, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		key.public = public
+		return key, nil
+	case jwt.SigningMethodEdDSA.Alg():
+		if config.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(config.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.private, key.public = private, private.(ed25519.PrivateKey).Public()
+			return key, nil
+		}
+		pem, err := os.ReadFile(config.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		public, err := jwt.ParseEdPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		key.public = public
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q, use one of %v", config.Alg, supportedAlgorithms)
+	}
+}
+
+func (ks *KeySet) signingKey(now time.Time) (*signingKey, error) {
+	for i := len(ks.keys) - 1; i >= 0; i-- {
+		key := ks.keys[i]
+		if key.private != nil && !key.activeFrom.After(now) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("setup keys: no private key is active yet; no key to sign tokens with")
+}
+
+func (ks *KeySet) retired(key *signingKey, now time.Time) bool {
+	for _, other := range ks.keys {
+		if other.activeFrom.After(key.activeFrom) && !other.activeFrom.After(now) {
+			return now.After(other.activeFrom.Add(ks.overlap))
+		}
+	}
+	return false
+}
+
+func (ks *KeySet) verificationKey(kid string, alg string, now time.Time) (*signingKey, error) {
+	for _, key := range ks.keys {
+		if key.kid != kid {
+			continue
+		}
+		if key.alg != alg {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", alg, kid)
+		}
+		if key.activeFrom.After(now) || ks.retired(key, now) {
+			return nil, fmt.Errorf("key %s is not active", kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+func (ks *KeySet) JWKS(now time.Time) JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		if ks.retired(key, now) {
+			continue
+		}
+		jwk := JWK{Use: "sig", Alg: key.alg, Kid: key.kid}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
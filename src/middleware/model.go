@@ -1,7 +1,30 @@
 package middleware
 
 type UserClaims struct {
-	Email       string `json:"email,omitempty"`
-	UserId      string `json:"userId,omitempty"`
-	SessionUUID string `json:"sessionId,omitempty"`
-}
\ No newline at end of file
+	Email       string   `json:"email,omitempty"`
+	UserId      string   `json:"userId,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	MFA         bool     `json:"mfa,omitempty"`
+	SessionUUID string   `json:"sessionId,omitempty"`
+}
+
+//Tokens issued before roles existed have no roles claim.
+func rolesFromPayload(payload map[string]interface{}) []string {
+	roles := make([]string, 0)
+	values, _ := payload["roles"].([]interface{})
+	for _, value := range values {
+		if role, ok := value.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+const (
+	ItemsWrite      = "items:write"
+	ItemsDelete     = "items:delete"
+	PricesWrite     = "prices:write"
+	CatalogManage   = "catalog:manage"
+	LocationsManage = "locations:manage"
+	DiscountsManage = "discounts:manage"
+	InventoryAdjust = "inventory:adjust"
+	RolesManage     = "roles:manage"
+	UsersManage     = "users:manage"
+)
+
+//A user has the union of the permissions of all their roles.
+var rolePermissions = map[string][]string{
+	"staff":     {ItemsWrite, ItemsDelete, PricesWrite, CatalogManage, LocationsManage, DiscountsManage, InventoryAdjust, RolesManage, UsersManage},
+	"catalog":   {ItemsWrite, PricesWrite, CatalogManage},
+	"warehouse": {InventoryAdjust, LocationsManage},
+	"marketing": {DiscountsManage},
+}
+
+func Permissions() []string {
+	seen := map[string]bool{}
+	permissions := make([]string, 0)
+	for _, rolePermissions := range rolePermissions {
+		for _, permission := range rolePermissions {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+func Roles() []string {
+	roles := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func rolesHavePermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//The permissions of the roles in MFA_REQUIRED_ROLES may only be used after logging in with two-factor authentication.
+func rolesWithoutMFA(roles []string) []string {
+	required := strings.Split(utils.GetEnv("MFA_REQUIRED_ROLES", ""), ",")
+	allowed := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if !hasRole(required, role) {
+			allowed = append(allowed, role)
+		}
+	}
+	return allowed
+}
+
+func RequiresMFA(roles []string) bool {
+	return len(rolesWithoutMFA(roles)) != len(roles)
+}
+
+func HasPermission(r *http.Request, permission string) bool {
+	principal, ok := PrincipalFromContext(r.Context())
+	return ok && principal.HasPermission(permission)
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type Principal struct {
+	UserId    string
+	Email     string
+	Roles     []string
+	MFA       bool
+	TokenId   string
+	ExpiresAt int64
+	APIKeyId  string
+	Scopes    []string
+}
+
+type principalKey struct{}
+
+//The identityHeaders were used to pass the user to handlers before the principal was stored in the request context. They are removed from every incoming request so a client can't pose as another user by sending them.
+var identityHeaders = []string{"userId", "role"}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+func (p *Principal) activeRoles() []string {
+	if p.MFA {
+		return p.Roles
+	}
+	return rolesWithoutMFA(p.Roles)
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return hasRole(p.activeRoles(), role)
+}
+
+//Requests made with an API key are also limited to the permissions the key was scoped to.
+func (p *Principal) HasPermission(permission string) bool {
+	if p.APIKeyId != "" && !hasRole(p.Scopes, permission) {
+		return false
+	}
+	return rolesHavePermission(p.activeRoles(), permission)
+}
+
+func stripIdentityHeaders(r *http.Request) {
+	for _, header := range identityHeaders {
+		r.Header.Del(header)
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/responses"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/go-chi/chi"
+)
+
+//Requests are limited with the generic cell rate algorithm (GCRA): a client may send Burst requests at once, after which one more request is allowed every Period/Limit.
+//Only the theoretical arrival time of the next request is stored per client, so a limit costs a single key in Redis.
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+//Redis shares the limits between all instances of the API; the in memory store is used for a single instance, in tests, and while Redis is unavailable.
+type RateLimitStore interface {
+	AllowGCRA(ctx context.Context, key string, interval time.Duration, burst int) (*RateLimitResult, error)
+}
+
+//Policies are read from RATE_LIMIT_<NAME>_LIMIT, _PERIOD and _BURST, e.g. RATE_LIMIT_ITEMS_READ_LIMIT. The burst defaults to the limit.
+func NewRateLimitPolicy(name string, limit int, period time.Duration) *RateLimitPolicy {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	policy := &RateLimitPolicy{
+		Name:   name,
+		Limit:  utils.GetEnvInt(prefix+"_LIMIT", limit),
+		Period: utils.GetEnvDuration(prefix+"_PERIOD", period),
+	}
+	policy.Burst = utils.GetEnvInt(prefix+"_BURST", policy.Limit)
+	if policy.Limit < 1 {
+		policy.Limit = 1
+	}
+	if policy.Burst < 1 {
+		policy.Burst = 1
+	}
+	//the Redis store counts in whole milliseconds and divides by the interval
+	if policy.interval() < time.Millisecond {
+		log.Printf("%s: %d requests per %s is more than one per millisecond, using %d per %s", prefix, policy.Limit, policy.Period, limit, period)
+		policy.Limit = limit
+		policy.Period = period
+	}
+	return policy
+}
+
+func (p *RateLimitPolicy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+func rateLimitClient(r *http.Request) string {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		if principal.APIKeyId != "" {
+			return "key:" + principal.APIKeyId
+		}
+		return "user:" + principal.UserId
+	}
+	return "ip:" + utils.ClientIP(r)
+}
+
+func rateLimitRoute(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return r.Method + ":" + pattern
+		}
+	}
+	return r.Method + ":" + r.URL.Path
+}
+
+func secondsCeil(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func (c *middlewareController) RateLimit(policy *RateLimitPolicy) Adapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := fmt.Sprintf("rate_limits:%s:%s:%s", policy.Name, rateLimitRoute(r), rateLimitClient(r))
+			result, err := c.rateLimits.AllowGCRA(r.Context(), key, policy.interval(), policy.Burst)
+			if err != nil {
+				c.reportRateLimitError(err)
+				result, err = c.fallbackRateLimits.AllowGCRA(r.Context(), key, policy.interval(), policy.Burst)
+				if err != nil {
+					responses.Error(w, r, err)
+					return
+				}
+			}
+			headers := w.Header()
+			headers.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", policy.Limit, secondsCeil(policy.Period), policy.Burst))
+			headers.Set("RateLimit-Limit", strconv.Itoa(policy.Burst))
+			headers.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			headers.Set("RateLimit-Reset", strconv.Itoa(secondsCeil(result.ResetAfter)))
+			if !result.Allowed {
+				headers.Set("Retry-After", strconv.Itoa(secondsCeil(result.RetryAfter)))
+				responses.JSONError(w, "Too many requests. Try again later.", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		})
+	}
+}
+
+//Every request fails the same way while Redis is down, so this is logged at most once a minute.
+func (c *middlewareController) reportRateLimitError(err error) {
+	now := time.Now().UnixNano()
+	reportedAt := atomic.LoadInt64(&c.rateLimitErrorAt)
+	if now-reportedAt < int64(time.Minute) || !atomic.CompareAndSwapInt64(&c.rateLimitErrorAt, reportedAt, now) {
+		return
+	}
+	log.Printf("rate limit: limiting in memory: %v", err)
+}
+
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	arrivals map[string]time.Time
+	swept    time.Time
+	now      func() time.Time
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{arrivals: map[string]time.Time{}, now: time.Now}
+}
+
+func (s *memoryRateLimitStore) AllowGCRA(ctx context.Context, key string, interval time.Duration, burst int) (*RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.swept) > time.Minute {
+		for k, arrival := range s.arrivals {
+			if arrival.Before(now) {
+				delete(s.arrivals, k)
+			}
+		}
+		s.swept = now
+	}
+	arrival, ok := s.arrivals[key]
+	if !ok || arrival.Before(now) {
+		arrival = now
+	}
+	tolerance := interval * time.Duration(burst)
+	next := arrival.Add(interval)
+	allowAt := next.Add(-tolerance)
+	if allowAt.After(now) {
+		return &RateLimitResult{Allowed: false, RetryAfter: allowAt.Sub(now), ResetAfter: arrival.Sub(now)}, nil
+	}
+	s.arrivals[key] = next
+	return &RateLimitResult{Allowed: true, Remaining: int(now.Sub(allowAt) / interval), ResetAfter: next.Sub(now)}, nil
+}
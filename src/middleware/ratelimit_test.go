@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1600000000, 0)
+	store := &memoryRateLimitStore{arrivals: map[string]time.Time{}, now: func() time.Time { return now }}
+	interval := time.Second
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := store.AllowGCRA(ctx, "key", interval, 3)
+		if err != nil || !result.Allowed || result.Remaining != remaining {
+			t.Fatalf("request of the burst: %+v %v, want %d remaining", result, err, remaining)
+		}
+	}
+	result, _ := store.AllowGCRA(ctx, "key", interval, 3)
+	if result.Allowed || result.RetryAfter != interval || result.ResetAfter != 3*interval {
+		t.Errorf("request after the burst: %+v", result)
+	}
+	if result, _ := store.AllowGCRA(ctx, "other", interval, 3); !result.Allowed {
+		t.Errorf("another key was limited: %+v", result)
+	}
+
+	now = now.Add(interval)
+	if result, _ := store.AllowGCRA(ctx, "key", interval, 3); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("request an interval later: %+v", result)
+	}
+	if result, _ := store.AllowGCRA(ctx, "key", interval, 3); result.Allowed {
+		t.Errorf("second request an interval later: %+v", result)
+	}
+
+	now = now.Add(time.Hour)
+	if result, _ := store.AllowGCRA(ctx, "key", interval, 3); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("request after the limit refilled: %+v", result)
+	}
+}
+
+func TestNewRateLimitPolicy(t *testing.T) {
+	t.Setenv("RATE_LIMIT_TEST_LIMIT", "10")
+	t.Setenv("RATE_LIMIT_TEST_PERIOD", "1m")
+	policy := NewRateLimitPolicy("test", 5, time.Second)
+	if policy.Limit != 10 || policy.Period != time.Minute || policy.Burst != 10 || policy.interval() != 6*time.Second {
+		t.Errorf("policy %+v", *policy)
+	}
+
+	for _, period := range []string{"0s", "-1s", "5ms"} {
+		t.Setenv("RATE_LIMIT_TEST_PERIOD", period)
+		policy := NewRateLimitPolicy("test", 5, time.Second)
+		if policy.Limit != 5 || policy.Period != time.Second {
+			t.Errorf("period %s: policy %+v, want the default", period, *policy)
+		}
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) AllowGCRA(ctx context.Context, key string, interval time.Duration, burst int) (*RateLimitResult, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestRateLimitFallsBackToMemory(t *testing.T) {
+	c := NewMIddlewareController(nil, nil, failingRateLimitStore{})
+	handler := c.RateLimit(&RateLimitPolicy{Name: "test", Limit: 1, Period: time.Minute, Burst: 1})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/items", nil))
+		if w.Code != want {
+			t.Errorf("status %d, want %d", w.Code, want)
+		}
+	}
+}
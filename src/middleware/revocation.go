@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+//Revoked access tokens are kept in a denylist under their jti until they expire on their own.
+//For mass revocation every user has a watermark: access tokens of the user issued up to it are not accepted. Clients renew their access token from their session, so revoking tokens this way never logs a user out by itself.
+
+func revokedTokenKey(tokenId string) string {
+	return "revoked_tokens:" + tokenId
+}
+
+func tokensValidAfterKey(userId string) string {
+	return "tokens_valid_after:" + userId
+}
+
+func (s *service) RevokeAccessToken(ctx context.Context, tokenId string, expiresAt int64) error {
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if tokenId == "" || ttl <= 0 {
+		return nil
+	}
+	return s.redis.SetKey(ctx, revokedTokenKey(tokenId), 1, ttl)
+}
+
+func (s *service) RevokeUserTokens(ctx context.Context, userId string) error {
+	return s.redis.SetKey(ctx, tokensValidAfterKey(userId), time.Now().UnixMicro(), AccessTokenTTL)
+}
+
+func (s *service) IsAccessTokenRevoked(ctx context.Context, userId string, claims *TokenClaims) (bool, error) {
+	if claims.TokenId != "" {
+		_, err := s.redis.GetKey(ctx, revokedTokenKey(claims.TokenId))
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, apperrors.ErrNotFound) {
+			return false, err
+		}
+	}
+	validAfter, err := s.redis.GetKey(ctx, tokensValidAfterKey(userId))
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	watermark, err := strconv.ParseInt(validAfter, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	//the watermark and iat have microseconds, so the token of the refresh that follows a revocation is accepted
+	return claims.IssuedAt.UnixMicro() <= watermark, nil
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+type memoryDb struct {
+	InMemoryDb
+	keys map[string]string
+}
+
+func (db *memoryDb) GetKey(ctx context.Context, key string) (string, error) {
+	if value, ok := db.keys[key]; ok {
+		return value, nil
+	}
+	return "", apperrors.NotFound("not_found", "not found")
+}
+
+func (db *memoryDb) SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	db.keys[key] = fmt.Sprint(value)
+	return nil
+}
+
+func TestIsAccessTokenRevoked(t *testing.T) {
+	ctx := context.Background()
+	db := &memoryDb{keys: map[string]string{}}
+	s := &service{redis: db}
+	now := time.Now()
+	if err := s.RevokeAccessToken(ctx, "revoked", now.Unix()+60); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeUserTokens(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	micros, err := strconv.ParseInt(db.keys[tokensValidAfterKey("1")], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watermark := time.UnixMicro(micros)
+	tests := []struct {
+		name    string
+		userId  string
+		claims  TokenClaims
+		revoked bool
+	}{
+		{"denylisted token", "2", TokenClaims{TokenId: "revoked", IssuedAt: now}, true},
+		{"token of another user", "2", TokenClaims{TokenId: "other", IssuedAt: now}, false},
+		{"token issued before the watermark", "1", TokenClaims{TokenId: "other", IssuedAt: watermark.Add(-time.Millisecond)}, true},
+		{"token issued at the watermark", "1", TokenClaims{TokenId: "other", IssuedAt: watermark}, true},
+		{"token issued in the second of the watermark after it", "1", TokenClaims{TokenId: "other", IssuedAt: watermark.Add(time.Microsecond)}, false},
+	}
+	for _, test := range tests {
+		if revoked, err := s.IsAccessTokenRevoked(ctx, test.userId, &test.claims); err != nil || revoked != test.revoked {
+			t.Errorf("%s: revoked %v, %v", test.name, revoked, err)
+		}
+	}
+}
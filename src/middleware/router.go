@@ -1,11 +1,13 @@
 package middleware
 
 import (
+	"time"
+
 	"github.com/go-chi/chi"
 )
 
 func MiddlewareRoutes(c Controller) *chi.Mux {
 	router := chi.NewRouter()
-	router.Post("/getaccesstoken", c.GetAccessToken)
+	router.With(c.Timeout(NewTimeoutPolicy("refresh", 3*time.Second))).Post("/getaccesstoken", c.GetAccessToken)
 	return router
-}
\ No newline at end of file
+}
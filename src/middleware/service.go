@@ -1,28 +1,56 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
 )
 
 type Service interface {
-	GetSession(userId string, sessionId string) (*UserClaims, error)
+	GetSession(ctx context.Context, userId string, sessionId string) (*UserClaims, error)
+	RotateRefreshToken(ctx context.Context, userId string, sessionId string, tokenId string, newTokenId string) error
+	RevokeSession(ctx context.Context, userId string, sessionId string) error
+	RevokeAccessToken(ctx context.Context, tokenId string, expiresAt int64) error
+	RevokeUserTokens(ctx context.Context, userId string) error
+	IsAccessTokenRevoked(ctx context.Context, userId string, claims *TokenClaims) (bool, error)
+	AuthenticateAPIKey(ctx context.Context, key string, ip string) (*Principal, error)
+}
+
+type Rdbms interface {
+	GetAPIKeyCredentials(ctx context.Context, prefix string) (*APIKeyCredentials, error)
+	GetRoles(ctx context.Context, userId string) ([]string, error)
+	TouchAPIKey(ctx context.Context, keyId string, resolution time.Duration) error
 }
 
 type InMemoryDb interface {
-	GetKey(key string) (string, error)
+	GetKey(ctx context.Context, key string) (string, error)
+	SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error
+	UpdateKey(ctx context.Context, key string, update func(value string) (string, error)) error
+	SetKeyNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error)
+	DeleteKeys(ctx context.Context, keys ...string) (int64, error)
+	RemoveFromSet(ctx context.Context, key string, members ...interface{}) error
 }
 
+var ErrRefreshTokenReused = apperrors.Unauthorized("refresh_token_reused", "refresh token has already been used")
+
+//A used refresh token id is remembered for as long as the session it belongs to can live.
+const usedRefreshTokenTTL = 24 * 30 * time.Hour
+
 type service struct {
 	redis InMemoryDb
+	rdbms Rdbms
 }
 
-func NewMiddlewareService(a InMemoryDb) Service {
-	return &service{redis: a}
+func NewMiddlewareService(a InMemoryDb, b Rdbms) Service {
+	return &service{redis: a, rdbms: b}
 }
 
-func (s *service) GetSession(userId string, sessionId string) (*UserClaims, error) {
+func (s *service) GetSession(ctx context.Context, userId string, sessionId string) (*UserClaims, error) {
 	keyName := "sessions:" + userId + ":" + sessionId
-	result, err := s.redis.GetKey(keyName)
+	result, err := s.redis.GetKey(ctx, keyName)
 	if err != nil {
 		return nil, err
 	}
@@ -33,3 +61,55 @@ func (s *service) GetSession(userId string, sessionId string) (*UserClaims, erro
 	}
 	return claims, nil
 }
+
+//Presenting a refresh token that is not the current one of the session, or presenting it twice, means it has been stolen; the whole session is revoked and ErrRefreshTokenReused is returned.
+func (s *service) RotateRefreshToken(ctx context.Context, userId string, sessionId string, tokenId string, newTokenId string) error {
+	keyName := "sessions:" + userId + ":" + sessionId
+	if tokenId != "" {
+		firstUse, err := s.redis.SetKeyNX(ctx, "used_refresh_tokens:"+tokenId, sessionId, usedRefreshTokenTTL)
+		if err != nil {
+			return err
+		}
+		if !firstUse {
+			if err := s.revokeStolenSession(ctx, userId, sessionId); err != nil {
+				return err
+			}
+			return ErrRefreshTokenReused
+		}
+	}
+	err := s.redis.UpdateKey(ctx, keyName, func(value string) (string, error) {
+		session := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(value), &session); err != nil {
+			return "", err
+		}
+		//tokens issued before rotation existed carry no id and are accepted once, while the session has no current token yet
+		currentTokenId, _ := session["refreshTokenId"].(string)
+		if currentTokenId != tokenId {
+			return "", ErrRefreshTokenReused
+		}
+		session["refreshTokenId"] = newTokenId
+		session["lastUsedAt"] = time.Now().Unix()
+		sessionJson, err := json.Marshal(session)
+		return string(sessionJson), err
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		if err := s.revokeStolenSession(ctx, userId, sessionId); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *service) RevokeSession(ctx context.Context, userId string, sessionId string) error {
+	if _, err := s.redis.DeleteKeys(ctx, "sessions:"+userId+":"+sessionId); err != nil {
+		return err
+	}
+	return s.redis.RemoveFromSet(ctx, "user_sessions:"+userId, sessionId)
+}
+
+func (s *service) revokeStolenSession(ctx context.Context, userId string, sessionId string) error {
+	if err := s.RevokeSession(ctx, userId, sessionId); err != nil {
+		return err
+	}
+	return s.RevokeUserTokens(ctx, userId)
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func (db *memoryDb) SetKeyNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	if _, ok := db.keys[key]; ok {
+		return false, nil
+	}
+	return true, db.SetKey(ctx, key, value, exp)
+}
+
+func (db *memoryDb) UpdateKey(ctx context.Context, key string, update func(value string) (string, error)) error {
+	value, err := db.GetKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	updated, err := update(value)
+	if err != nil {
+		return err
+	}
+	db.keys[key] = updated
+	return nil
+}
+
+func (db *memoryDb) DeleteKeys(ctx context.Context, keys ...string) (int64, error) {
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := db.keys[key]; ok {
+			delete(db.keys, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (db *memoryDb) RemoveFromSet(ctx context.Context, key string, members ...interface{}) error {
+	return nil
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	db := &memoryDb{keys: map[string]string{"sessions:1:s": `{"roles":["admin"],"refreshTokenId":"a"}`}}
+	s := &service{redis: db}
+	if err := s.RotateRefreshToken(ctx, "1", "s", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	session := struct {
+		Roles          []string `json:"roles"`
+		RefreshTokenId string   `json:"refreshTokenId"`
+		LastUsedAt     int64    `json:"lastUsedAt"`
+	}{}
+	if err := json.Unmarshal([]byte(db.keys["sessions:1:s"]), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.RefreshTokenId != "b" || len(session.Roles) != 1 || session.LastUsedAt == 0 {
+		t.Errorf("rotated session %+v", session)
+	}
+	if err := s.RotateRefreshToken(ctx, "1", "s", "a", "c"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("reuse of a rotated token: %v", err)
+	}
+	if _, ok := db.keys["sessions:1:s"]; ok {
+		t.Error("session of a reused token was not revoked")
+	}
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+//The TimeoutPolicy bounds how long a route may wait for the database, Redis and other services. The deadline is set on the request context, which the services pass to every query, and a client that disconnects cancels it too.
+type TimeoutPolicy struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func NewTimeoutPolicy(name string, timeout time.Duration) *TimeoutPolicy {
+	key := "TIMEOUT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	return &TimeoutPolicy{Name: name, Timeout: utils.GetEnvDuration(key, timeout)}
+}
+
+//A deadline set earlier, e.g. by an outer router, is kept if it is sooner.
+func (c *middlewareController) Timeout(policy *TimeoutPolicy) Adapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), policy.Timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: e_shop migrate <command>
+
+commands:
+  up [version]   apply the pending migrations, up to the version if given
+  down [steps]   roll back the last applied migrations, 1 by default
+  status         list the migrations and whether they are applied`
+
+func Command(ctx context.Context, m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf(usage)
+	}
+	number := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%q is not a positive number\n%s", args[1], usage)
+		}
+		number = n
+	}
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx, number)
+		for _, migration := range done {
+			fmt.Fprintf(out, "applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		return err
+	case "down":
+		if number == 0 {
+			number = 1
+		}
+		done, err := m.Down(ctx, number)
+		for _, migration := range done {
+			fmt.Fprintf(out, "rolled back %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "no applied migrations")
+		}
+		return err
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf(usage)
+		}
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			state, appliedAt := "pending", ""
+			if status.Applied {
+				state, appliedAt = "applied", status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Modified {
+				state = "modified"
+			} else if status.Missing {
+				state = "missing"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
@@ -0,0 +1,300 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The migrations are embedded in the binary as pairs of files, NNNN_name.up.sql and NNNN_name.down.sql: the MySQL ones in sql, the SQLite ones in sqlite. Every migration is written for both, with the same version and name.
+//A migration that was applied must not be changed; add a new one instead.
+//
+//go:embed sql/*.sql sqlite/*.sql
+var files embed.FS
+
+//The lockName is the advisory lock held while migrating, so instances started together don't apply the same migration twice.
+const lockName = "e_shop.schema_migrations"
+
+type dialect struct {
+	dir         string
+	createTable string
+	locks       bool
+}
+
+var mysqlDialect = dialect{
+	dir: "sql",
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    checksum CHAR(64) NOT NULL,
+    applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (version)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;`,
+	locks: true,
+}
+
+//SQLite has no advisory locks. The SQLite backend is meant for a single instance, which applies the migrations when it starts.
+//SQLite stores applied_at as TEXT, because the drivers turn DATETIME columns into time.Time while MySQL returns them as text.
+var sqliteDialect = dialect{
+	dir: "sqlite",
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);`,
+}
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+//A migration that was applied but is missing from the binary was applied by a newer version of the application.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool
+	Missing   bool
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+type Migrator struct {
+	db          *sql.DB
+	dialect     dialect
+	migrations  []Migration
+	lockTimeout time.Duration
+}
+
+//The statements of a migration run as one query, so the connections of the db must allow multiple statements.
+func New(db *sql.DB, lockTimeout time.Duration) (*Migrator, error) {
+	return newMigrator(db, mysqlDialect, lockTimeout)
+}
+
+func NewSQLite(db *sql.DB) (*Migrator, error) {
+	return newMigrator(db, sqliteDialect, 0)
+}
+
+func newMigrator(db *sql.DB, d dialect, lockTimeout time.Duration) (*Migrator, error) {
+	migrations, err := load(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: d, migrations: migrations, lockTimeout: lockTimeout}, nil
+}
+
+func load(dir string) ([]Migration, error) {
+	names, err := files.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, file := range names {
+		base := file.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: the name must end with .up.sql or .down.sql", base)
+		}
+		parts := strings.SplitN(strings.TrimSuffix(base, "."+direction+".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || version <= 0 {
+			return nil, fmt.Errorf("migration %s: the name must start with a positive version followed by an underscore", base)
+		}
+		data, err := files.ReadFile(path.Join(dir, base))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		} else if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d: %s and %s have the same version", version, m.Name, parts[1])
+		}
+		if direction == "up" {
+			m.Up = string(data)
+			sum := sha256.Sum256(data)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(data)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: both the up and the down migration are required", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+//Up refuses to run if an applied migration was changed or is missing from the binary. MySQL commits DDL statements implicitly, so a migration that fails halfway is left partially applied and has to be repaired by hand.
+func (m *Migrator) Up(ctx context.Context, target int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkDrift(applied); err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok || (target != 0 && migration.Version > target) {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, migration.Up); err != nil {
+				return fmt.Errorf("migration %d_%s failed and may be partially applied: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations(version, name, checksum) VALUES (?, ?, ?);", migration.Version, migration.Name, migration.Checksum); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkDrift(applied); err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, migration.Down); err != nil {
+				return fmt.Errorf("rolling back migration %d_%s failed and may be partially done: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?;", migration.Version); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if a, ok := applied[migration.Version]; ok {
+				status.Applied = true
+				status.AppliedAt = a.appliedAt
+				status.Modified = a.checksum != migration.Checksum
+				delete(applied, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+		for _, a := range applied {
+			statuses = append(statuses, MigrationStatus{Version: a.version, Name: a.name, Applied: true, AppliedAt: a.appliedAt, Missing: true})
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+		return nil
+	})
+	return statuses, err
+}
+
+func (m *Migrator) checkDrift(applied map[int]appliedMigration) error {
+	known := map[int]Migration{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+	for version, a := range applied {
+		migration, ok := known[version]
+		if !ok {
+			return fmt.Errorf("migration %d_%s is applied but unknown to this version of the application", version, a.name)
+		}
+		if migration.Checksum != a.checksum {
+			return fmt.Errorf("migration %d_%s was changed after it was applied", version, migration.Name)
+		}
+	}
+	return nil
+}
+
+//GET_LOCK locks are owned by the session, so every statement has to use the same connection.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if m.dialect.locks {
+		var acquired sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?);", lockName, int(m.lockTimeout.Seconds())).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired.Int64 != 1 {
+			return fmt.Errorf("another instance is migrating the database: the lock was not released within %s", m.lockTimeout)
+		}
+		defer func() {
+			if _, releaseErr := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?);", lockName); releaseErr != nil && err == nil {
+				err = releaseErr
+			}
+		}()
+	}
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		a := appliedMigration{}
+		var appliedAt []byte
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &appliedAt); err != nil {
+			return nil, err
+		}
+		a.appliedAt, _ = time.Parse("2006-01-02 15:04:05", string(appliedAt))
+		applied[a.version] = a
+	}
+	return applied, rows.Err()
+}
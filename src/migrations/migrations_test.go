@@ -0,0 +1,202 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file::memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestDialectsHaveTheSameMigrations(t *testing.T) {
+	mysql, err := load(mysqlDialect.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := load(sqliteDialect.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(migrations []Migration) []string {
+		var names []string
+		for _, m := range migrations {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+	if !reflect.DeepEqual(names(mysql), names(sqlite)) {
+		t.Fatalf("mysql migrations %v, sqlite migrations %v", names(mysql), names(sqlite))
+	}
+	for i := range mysql {
+		if mysql[i].Version != sqlite[i].Version {
+			t.Errorf("%s: mysql version %d, sqlite version %d", mysql[i].Name, mysql[i].Version, sqlite[i].Version)
+		}
+	}
+}
+
+var (
+	createTable = regexp.MustCompile(`(?s)CREATE TABLE (\w+) \((.*?)\n\)`)
+	dropTable   = regexp.MustCompile(`DROP TABLE (\w+)`)
+	addColumn   = regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+	dropColumn  = regexp.MustCompile(`ALTER TABLE (\w+) DROP COLUMN (\w+)`)
+)
+
+//There is no MySQL server to apply the migrations to, so the tables and columns they create are read from their statements.
+func mysqlTables(t *testing.T) map[string][]string {
+	migrations, err := load(mysqlDialect.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string][]string{}
+	for _, m := range migrations {
+		for _, match := range createTable.FindAllStringSubmatch(m.Up, -1) {
+			var columns []string
+			for _, line := range strings.Split(match[2], "\n") {
+				fields := strings.Fields(line)
+				if len(fields) < 2 || strings.HasPrefix(fields[0], "--") {
+					continue
+				}
+				switch fields[0] {
+				case "PRIMARY", "UNIQUE", "KEY", "INDEX", "CONSTRAINT", "FOREIGN":
+					continue
+				}
+				columns = append(columns, fields[0])
+			}
+			tables[match[1]] = columns
+		}
+		for _, match := range addColumn.FindAllStringSubmatch(m.Up, -1) {
+			tables[match[1]] = append(tables[match[1]], match[2])
+		}
+		for _, match := range dropColumn.FindAllStringSubmatch(m.Up, -1) {
+			columns := tables[match[1]][:0]
+			for _, column := range tables[match[1]] {
+				if column != match[2] {
+					columns = append(columns, column)
+				}
+			}
+			tables[match[1]] = columns
+		}
+		for _, match := range dropTable.FindAllStringSubmatch(m.Up, -1) {
+			delete(tables, match[1])
+		}
+	}
+	return tables
+}
+
+func sqliteTables(t *testing.T, db *sql.DB) map[string][]string {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence');")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	tables := map[string][]string{}
+	for _, name := range names {
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid;", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var columns []string
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				t.Fatal(err)
+			}
+			columns = append(columns, column)
+		}
+		rows.Close()
+		tables[name] = columns
+	}
+	return tables
+}
+
+func TestSQLiteSchemaMatchesMySQL(t *testing.T) {
+	db := openSQLite(t)
+	m, err := NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := mysqlTables(t)
+	got := sqliteTables(t, db)
+	if len(want) == 0 {
+		t.Fatal("no tables found in the mysql migrations")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlite tables %v,\nmysql tables %v", got, want)
+	}
+}
+
+func TestSQLiteUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	m, err := NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := m.Up(ctx, 2)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("up to 2 applied %d migrations: %v", len(done), err)
+	}
+	done, err = m.Up(ctx, 0)
+	if err != nil || len(done) != len(m.migrations)-2 {
+		t.Fatalf("up applied %d migrations: %v", len(done), err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.Modified || status.Missing || status.AppliedAt.IsZero() {
+			t.Errorf("status %+v", status)
+		}
+	}
+	done, err = m.Down(ctx, len(m.migrations))
+	if err != nil || len(done) != len(m.migrations) {
+		t.Fatalf("down rolled back %d migrations: %v", len(done), err)
+	}
+	if tables := sqliteTables(t, db); len(tables) != 0 {
+		t.Errorf("tables left after rolling back every migration: %v", tables)
+	}
+}
+
+func TestChangedMigrationIsRefused(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	m, err := NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE schema_migrations SET checksum = 'changed' WHERE version = 1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx, 0); err == nil || !strings.Contains(err.Error(), "was changed") {
+		t.Errorf("up after a changed migration: %v", err)
+	}
+}
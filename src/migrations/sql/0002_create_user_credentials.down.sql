@@ -0,0 +1,3 @@
+DROP TABLE api_keys;
+DROP TABLE user_identities;
+DROP TABLE user_recovery_codes;
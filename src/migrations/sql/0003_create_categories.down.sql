@@ -0,0 +1,3 @@
+DROP PROCEDURE delete_category;
+DROP PROCEDURE add_subcategory;
+DROP TABLE categories;
@@ -0,0 +1,33 @@
+-- Categories form a tree under the root category "all"; deleting a category deletes its subcategories.
+CREATE TABLE categories (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    parent_id INT UNSIGNED NULL,
+    user_id INT UNSIGNED NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY categories_name (name),
+    KEY categories_parent (parent_id),
+    CONSTRAINT categories_parent FOREIGN KEY (parent_id) REFERENCES categories (id) ON DELETE CASCADE,
+    CONSTRAINT categories_user FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+INSERT INTO categories (name) VALUES ('all');
+
+-- A missing parent is reported like a failed foreign key check (1452), so the API answers it as a validation error.
+CREATE PROCEDURE add_subcategory(IN category_name VARCHAR(100), IN parent_name VARCHAR(100), IN category_user_id INT UNSIGNED)
+BEGIN
+    DECLARE parent INT UNSIGNED DEFAULT NULL;
+    SELECT id INTO parent FROM categories WHERE name = parent_name;
+    IF parent IS NULL THEN
+        SIGNAL SQLSTATE '23000' SET MESSAGE_TEXT = 'The parent category does not exist.', MYSQL_ERRNO = 1452;
+    END IF;
+    INSERT INTO categories (name, parent_id, user_id) VALUES (category_name, parent, category_user_id);
+END;
+
+CREATE PROCEDURE delete_category(IN category_name VARCHAR(100))
+BEGIN
+    IF category_name = 'all' THEN
+        SIGNAL SQLSTATE '23000' SET MESSAGE_TEXT = 'The root category can not be deleted.', MYSQL_ERRNO = 1451;
+    END IF;
+    DELETE FROM categories WHERE name = category_name;
+END;
@@ -0,0 +1,28 @@
+CREATE TABLE brands (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY brands_name (name),
+    CONSTRAINT brands_user FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Items are soft deleted by setting deleted_at; the version is bumped by every write for the ETag preconditions.
+CREATE TABLE items (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id INT UNSIGNED NOT NULL,
+    category_id INT UNSIGNED NOT NULL,
+    brand_id INT UNSIGNED NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    modified_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    deleted_at DATETIME NULL,
+    price INT UNSIGNED NOT NULL,
+    discounted_price INT UNSIGNED NULL,
+    description TEXT NOT NULL,
+    version INT UNSIGNED NOT NULL DEFAULT 1,
+    PRIMARY KEY (id),
+    KEY items_deleted (deleted_at),
+    CONSTRAINT items_user FOREIGN KEY (user_id) REFERENCES users (id),
+    CONSTRAINT items_category FOREIGN KEY (category_id) REFERENCES categories (id),
+    CONSTRAINT items_brand FOREIGN KEY (brand_id) REFERENCES brands (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,4 @@
+DROP TABLE items_discounts;
+DROP TABLE discounts;
+DROP TABLE locations;
+DROP TABLE sizes;
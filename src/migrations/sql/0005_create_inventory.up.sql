@@ -0,0 +1,39 @@
+CREATE TABLE sizes (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY sizes_name (name),
+    CONSTRAINT sizes_user FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE locations (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    address VARCHAR(255) NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT locations_user FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE discounts (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    code VARCHAR(50) NOT NULL,
+    -- a fixed amount like "4.99" or a percentage like "15%"
+    amount VARCHAR(20) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    user_id INT UNSIGNED NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY discounts_code (code),
+    CONSTRAINT discounts_user FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+
+-- Deleting a discount or an item removes the discount from the item.
+CREATE TABLE items_discounts (
+    item_id INT UNSIGNED NOT NULL,
+    discount_id INT UNSIGNED NOT NULL,
+    valid_at DATETIME NOT NULL,
+    PRIMARY KEY (item_id, discount_id),
+    KEY items_discounts_discount (discount_id),
+    CONSTRAINT items_discounts_item FOREIGN KEY (item_id) REFERENCES items (id) ON DELETE CASCADE,
+    CONSTRAINT items_discounts_discount FOREIGN KEY (discount_id) REFERENCES discounts (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,11 @@
+-- SQLite has no stored procedures; the repository checks the parent and the root category instead.
+CREATE TABLE categories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    parent_id INTEGER NULL REFERENCES categories (id) ON DELETE CASCADE,
+    user_id INTEGER NULL REFERENCES users (id)
+);
+
+CREATE INDEX categories_parent ON categories (parent_id);
+
+INSERT INTO categories (name) VALUES ('all');
@@ -0,0 +1,21 @@
+CREATE TABLE brands (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    category_id INTEGER NOT NULL REFERENCES categories (id),
+    brand_id INTEGER NULL REFERENCES brands (id),
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    modified_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    deleted_at DATETIME NULL,
+    price INTEGER NOT NULL,
+    discounted_price INTEGER NULL,
+    description TEXT NOT NULL,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX items_deleted ON items (deleted_at);
@@ -0,0 +1,28 @@
+CREATE TABLE sizes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE locations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    address TEXT NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE discounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code TEXT NOT NULL UNIQUE,
+    amount TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE items_discounts (
+    item_id INTEGER NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    discount_id INTEGER NOT NULL REFERENCES discounts (id) ON DELETE CASCADE,
+    valid_at DATETIME NOT NULL,
+    PRIMARY KEY (item_id, discount_id)
+);
+
+CREATE INDEX items_discounts_discount ON items_discounts (discount_id);
@@ -0,0 +1,351 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+//The Value of an Operation is kept raw so an absent value can be told apart from null.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func invalidPatch(format string, values ...interface{}) error {
+	return apperrors.Validation("invalid_patch", fmt.Sprintf(format, values...))
+}
+
+func conflict(code string, format string, values ...interface{}) error {
+	return apperrors.Conflict(code, fmt.Sprintf(format, values...))
+}
+
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return value, nil
+}
+
+func Merge(document []byte, patch []byte) ([]byte, error) {
+	target, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+	mergePatch, err := decode(patch)
+	if err != nil {
+		return nil, invalidPatch("The merge patch is not valid JSON: %s", err)
+	}
+	return json.Marshal(merge(target, mergePatch))
+}
+
+func merge(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = merge(targetObject[name], value)
+	}
+	return targetObject
+}
+
+//Nothing is applied if one of the operations fails.
+func Apply(document []byte, patch []byte) ([]byte, error) {
+	target, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+	var operations []Operation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, invalidPatch("The JSON patch must be an array of operations: %s", err)
+	}
+	for i, operation := range operations {
+		target, err = apply(target, operation)
+		if err != nil {
+			var domainError *apperrors.Error
+			if errors.As(err, &domainError) {
+				domainError.Message = fmt.Sprintf("Operation %d: %s", i, domainError.Message)
+			}
+			return nil, err
+		}
+	}
+	return json.Marshal(target)
+}
+
+func apply(document interface{}, operation Operation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, invalidPatch("The %s operation requires a value.", operation.Op)
+		}
+		value, err := decode(operation.Value)
+		if err != nil {
+			return nil, invalidPatch("The value is not valid JSON: %s", err)
+		}
+		switch operation.Op {
+		case "add":
+			return add(document, path, value)
+		case "replace":
+			if _, err := get(document, path); err != nil || len(path) == 0 {
+				return value, err
+			}
+			if document, err = remove(document, path); err != nil {
+				return nil, err
+			}
+			return add(document, path, value)
+		default:
+			current, err := get(document, path)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(current, value) {
+				return nil, conflict("patch_test_failed", "The value at %s is not the tested value.", operation.Path)
+			}
+			return document, nil
+		}
+	case "remove":
+		return remove(document, path)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+				return nil, invalidPatch("A value can't be moved into one of its children.")
+			}
+			if document, err = remove(document, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = clone(value)
+		}
+		return add(document, path, value)
+	}
+	return nil, invalidPatch("Unknown operation %q.", operation.Op)
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalidPatch("The path %q must start with a slash.", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(array []interface{}, token string, appending bool) (int, error) {
+	if appending && token == "-" {
+		return len(array), nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, invalidPatch("%q is not an array index.", token)
+	}
+	max := len(array) - 1
+	if appending {
+		max = len(array)
+	}
+	if index > max {
+		return 0, conflict("patch_path_not_found", "The array index %d is out of range.", index)
+	}
+	return index, nil
+}
+
+func get(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, conflict("patch_path_not_found", "The member %q doesn't exist.", token)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			document = node[index]
+		default:
+			return nil, conflict("patch_path_not_found", "The member %q doesn't exist.", token)
+		}
+	}
+	return document, nil
+}
+
+func add(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return document, nil
+	case []interface{}:
+		index, err := arrayIndex(node, token, true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return set(document, path[:len(path)-1], node)
+	}
+	return nil, conflict("patch_path_not_found", "The parent of %q is not an object or an array.", token)
+}
+
+func remove(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, invalidPatch("The whole document can't be removed.")
+	}
+	parent, err := get(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[token]; !ok {
+			return nil, conflict("patch_path_not_found", "The member %q doesn't exist.", token)
+		}
+		delete(node, token)
+		return document, nil
+	case []interface{}:
+		index, err := arrayIndex(node, token, false)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:index:index], node[index+1:]...)
+		return set(document, path[:len(path)-1], node)
+	}
+	return nil, conflict("patch_path_not_found", "The member %q doesn't exist.", token)
+}
+
+//Arrays that grew or shrank are put back into their parent with set.
+func set(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+	case []interface{}:
+		index, err := arrayIndex(node, token, false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	}
+	return document, nil
+}
+
+func clone(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(node))
+		for name, member := range node {
+			object[name] = clone(member)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(node))
+		for i, element := range node {
+			array[i] = clone(element)
+		}
+		return array
+	}
+	return value
+}
+
+//Numbers are equal if they have the same value, e.g. 1 and 1.0.
+func equal(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, value := range x {
+			other, ok := y[name]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
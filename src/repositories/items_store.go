@@ -0,0 +1,298 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/fnmzgdt/e_shop/src/items"
+)
+
+//The insertBatchSize bounds the rows of one multi-row INSERT, keeping the statement well under the placeholder limits of the databases.
+const insertBatchSize = 500
+
+//The itemColumns are the columns of an items.ItemGet, in the order scanItem reads them.
+func (s *sqlStore) itemColumns() string {
+	return fmt.Sprintf("id, user_id, category_id, COALESCE(brand_id, 0), %s, price, COALESCE(discounted_price, 0), description, %s, version", s.dialect.unixTimestamp("created_at"), s.dialect.unixTimestamp("modified_at"))
+}
+
+func scanItem(row interface{ Scan(...interface{}) error }, item *items.ItemGet) error {
+	return row.Scan(&item.Id, &item.UserId, &item.CategoryId, &item.BrandId, &item.CreatedAt, &item.Price, &item.DiscountedPrice, &item.Description, &item.ModifiedAt, &item.Version)
+}
+
+func (s *sqlStore) InsertItem(ctx context.Context, item *items.ItemPost) (int, error) {
+	query := fmt.Sprintf("INSERT INTO items(user_id, category_id, brand_id, created_at, price, discounted_price, description) VALUES (?, ?, ?, %s, ?, ?, ?);", s.dialect.fromUnixTime("?"))
+	id, err := s.execInsert(ctx, query, item.UserId, item.CategoryId, item.BrandId, item.CreatedAt, item.Price, item.DiscountedPrice, item.Description)
+	return int(id), err
+}
+
+func (s *sqlStore) GetItem(ctx context.Context, id int) (*items.ItemGet, error) {
+	query := fmt.Sprintf("SELECT %s FROM items WHERE id = (?) AND deleted_at IS NULL;", s.itemColumns())
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	item := items.ItemGet{}
+	if err := scanItem(s.conn(ctx).QueryRowContext(ctx, query, id), &item); err != nil {
+		return nil, s.error(err, query)
+	}
+	return &item, nil
+}
+
+func (s *sqlStore) GetItems(ctx context.Context, limit int) (*[]items.ItemGet, error) {
+	query := fmt.Sprintf("SELECT %s FROM items WHERE deleted_at IS NULL LIMIT ?;", s.itemColumns())
+	itemsArray := make([]items.ItemGet, 0)
+	err := s.scanRows(ctx, query, []interface{}{limit}, func(rows *sql.Rows) error {
+		item := items.ItemGet{}
+		if err := scanItem(rows, &item); err != nil {
+			return err
+		}
+		itemsArray = append(itemsArray, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &itemsArray, nil
+}
+
+func (s *sqlStore) UpdateItem(ctx context.Context, item *items.ItemPatch) (int64, error) {
+	var params []interface{}
+	query := "UPDATE items SET"
+	if item.CategoryId != 0 {
+		query += " category_id = (?),"
+		params = append(params, item.CategoryId)
+	}
+	if item.BrandId != 0 {
+		query += " brand_id = (?),"
+		params = append(params, item.BrandId)
+	}
+	if item.Price != 0 {
+		query += " price = (?),"
+		params = append(params, item.Price)
+	}
+	if item.Discount { //when discounted is true and discountedPrice = 0 / null : set it to null
+		query += " discounted_price = NULLIF(?, 0),"
+		params = append(params, item.DiscountedPrice)
+	}
+	if item.Description != "" {
+		query += " description = (?),"
+		params = append(params, item.Description)
+	}
+	if item.ModifiedAt != 0 {
+		query += " modified_at = " + s.dialect.fromUnixTime("?") + ","
+		params = append(params, item.ModifiedAt)
+	}
+	if item.ChangeDeleted {
+		query += " deleted_at = " + s.dialect.fromUnixTime("NULLIF(?, 0)") + ","
+		params = append(params, item.DeletedAt)
+	}
+	query += " version = version + 1 WHERE id = (?) AND version = (?);"
+	params = append(params, item.Id, item.Version)
+	return s.execRowsAffected(ctx, query, params...)
+}
+
+func (s *sqlStore) GetItemDocument(ctx context.Context, id int) (*items.ItemDocument, error) {
+	query := fmt.Sprintf("SELECT id, category_id, brand_id, price, discounted_price, description, %s, version FROM items WHERE id = (?);", s.dialect.unixTimestamp("deleted_at"))
+	item := items.ItemDocument{}
+	if err := s.scanRow(ctx, query, []interface{}{id}, &item.Id, &item.CategoryId, &item.BrandId, &item.Price, &item.DiscountedPrice, &item.Description, &item.DeletedAt, &item.Version); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (s *sqlStore) PatchItem(ctx context.Context, current *items.ItemDocument, patched *items.ItemDocument, modifiedAt int) (int64, error) {
+	var params []interface{}
+	query := "UPDATE items SET"
+	if patched.CategoryId != current.CategoryId {
+		query += " category_id = (?),"
+		params = append(params, patched.CategoryId)
+	}
+	if !sameInt(patched.BrandId, current.BrandId) {
+		query += " brand_id = (?),"
+		params = append(params, patched.BrandId)
+	}
+	if patched.Price != current.Price {
+		query += " price = (?),"
+		params = append(params, patched.Price)
+	}
+	if !sameInt(patched.DiscountedPrice, current.DiscountedPrice) {
+		query += " discounted_price = (?),"
+		params = append(params, patched.DiscountedPrice)
+	}
+	if patched.Description != current.Description {
+		query += " description = (?),"
+		params = append(params, patched.Description)
+	}
+	if !sameInt(patched.DeletedAt, current.DeletedAt) {
+		query += " deleted_at = " + s.dialect.fromUnixTime("?") + ","
+		params = append(params, patched.DeletedAt)
+	}
+	query += " modified_at = " + s.dialect.fromUnixTime("?") + ", version = version + 1 WHERE id = (?) AND version = (?);"
+	params = append(params, modifiedAt, current.Id, current.Version)
+	return s.execRowsAffected(ctx, query, params...)
+}
+
+func sameInt(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (s *sqlStore) DeleteItem(ctx context.Context, id int, version int) (int64, error) {
+	return s.execRowsAffected(ctx, "DELETE FROM items WHERE id = (?) AND version = (?);", id, version)
+}
+
+func (s *sqlStore) InsertBrand(ctx context.Context, brand *items.Brand) (int64, error) {
+	return s.execInsert(ctx, "INSERT INTO brands(name, user_id) VALUES(?, ?);", brand.Name, brand.UserId)
+}
+
+func (s *sqlStore) insertRows(ctx context.Context, insert string, row string, rows [][]interface{}) error {
+	for start := 0; start < len(rows); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		placeholders := make([]string, 0, end-start)
+		values := make([]interface{}, 0, (end-start)*len(rows[start]))
+		for _, r := range rows[start:end] {
+			placeholders = append(placeholders, row)
+			values = append(values, r...)
+		}
+		if _, err := s.exec(ctx, insert+" VALUES "+strings.Join(placeholders, ", ")+";", values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//A multi-row INSERT reports the id of only one of its rows, and with the interleaved auto-increment lock mode MySQL 8 uses by default the ids of its rows needn't be consecutive, so the ids are read back: they are the ones above the highest id before the INSERT, in the order of the rows.
+//Rows other transactions insert meanwhile are not in the snapshot of the transaction; with an isolation level below REPEATABLE READ they may be, which the count of the ids gives away.
+func (s *sqlStore) insertRowsReturningIds(ctx context.Context, table string, insert string, row string, rows [][]interface{}) ([]int, error) {
+	var ids []int
+	err := s.InTransaction(ctx, func(ctx context.Context) error {
+		var lastId int
+		if err := s.scanRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM "+table+";", nil, &lastId); err != nil {
+			return err
+		}
+		if err := s.insertRows(ctx, insert, row, rows); err != nil {
+			return err
+		}
+		ids = make([]int, 0, len(rows))
+		err := s.scanRows(ctx, "SELECT id FROM "+table+" WHERE id > ? ORDER BY id;", []interface{}{lastId}, func(r *sql.Rows) error {
+			var id int
+			if err := r.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) != len(rows) {
+			return errWriteConflict(fmt.Errorf("%d rows inserted into %s, %d read back", len(rows), table, len(ids)))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s *sqlStore) deleteRows(ctx context.Context, table string, column string, values []interface{}) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s);", table, column, strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", "))
+	_, err := s.exec(ctx, query, values...)
+	return err
+}
+
+func (s *sqlStore) InsertSizes(ctx context.Context, sizes []items.Size) error {
+	rows := make([][]interface{}, len(sizes))
+	for i, size := range sizes {
+		rows[i] = []interface{}{size.Name, size.UserId}
+	}
+	ids, err := s.insertRowsReturningIds(ctx, "sizes", "INSERT INTO sizes(name, user_id)", "(?, ?)", rows)
+	if err != nil {
+		return err
+	}
+	for i := range sizes {
+		sizes[i].Id = ids[i]
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteSizes(ctx context.Context, sizes []items.Size) error {
+	names := make([]interface{}, len(sizes))
+	for i, size := range sizes {
+		names[i] = size.Name
+	}
+	return s.deleteRows(ctx, "sizes", "name", names)
+}
+
+func (s *sqlStore) InsertLocations(ctx context.Context, locations []items.Location) error {
+	rows := make([][]interface{}, len(locations))
+	for i, location := range locations {
+		rows[i] = []interface{}{location.Address, location.UserId}
+	}
+	ids, err := s.insertRowsReturningIds(ctx, "locations", "INSERT INTO locations(address, user_id)", "(?, ?)", rows)
+	if err != nil {
+		return err
+	}
+	for i := range locations {
+		locations[i].Id = ids[i]
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteLocations(ctx context.Context, locations []items.Location) error {
+	ids := make([]interface{}, len(locations))
+	for i, location := range locations {
+		ids[i] = location.Id
+	}
+	return s.deleteRows(ctx, "locations", "id", ids)
+}
+
+func (s *sqlStore) InsertDiscounts(ctx context.Context, discounts []items.Discount) error {
+	rows := make([][]interface{}, len(discounts))
+	for i, dis := range discounts {
+		rows[i] = []interface{}{dis.Code, dis.Amount, dis.ExpiresAt, dis.UserId}
+	}
+	ids, err := s.insertRowsReturningIds(ctx, "discounts", "INSERT INTO discounts(code, amount, expires_at, user_id)", "(?, ?, "+s.dialect.fromUnixTime("?")+", ?)", rows)
+	if err != nil {
+		return err
+	}
+	for i := range discounts {
+		discounts[i].Id = ids[i]
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteDiscounts(ctx context.Context, discounts []items.Discount) error {
+	ids := make([]interface{}, len(discounts))
+	for i, dis := range discounts {
+		ids[i] = dis.Id
+	}
+	return s.deleteRows(ctx, "discounts", "id", ids)
+}
+
+func (s *sqlStore) InsertItemDiscounts(ctx context.Context, itemdiscounts []items.ItemDiscount) error {
+	rows := make([][]interface{}, len(itemdiscounts))
+	for i, itemdis := range itemdiscounts {
+		rows[i] = []interface{}{itemdis.ItemId, itemdis.DiscountId, itemdis.ValidAt}
+	}
+	return s.insertRows(ctx, "INSERT INTO items_discounts(item_id, discount_id, valid_at)", "(?, ?, "+s.dialect.fromUnixTime("?")+")", rows)
+}
+
+func (s *sqlStore) CategoryExists(ctx context.Context, categoryId int) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM categories WHERE id = (?));", categoryId)
+}
+
+func (s *sqlStore) BrandExists(ctx context.Context, brandId int) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM brands WHERE id = (?));", brandId)
+}
+
+func (s *sqlStore) ItemExists(ctx context.Context, itemId string) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM items WHERE id = (?) AND deleted_at IS NULL);", itemId)
+}
+
+func (s *sqlStore) DiscountExists(ctx context.Context, discountId string) (bool, error) {
+	return s.exists(ctx, "SELECT EXISTS(SELECT 1 FROM discounts WHERE id = (?));", discountId)
+}
@@ -1,87 +1,110 @@
 package repositories
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/fnmzgdt/e_shop/src/items"
-	"github.com/fnmzgdt/e_shop/src/users"
+	"github.com/fnmzgdt/e_shop/src/migrations"
 	"github.com/fnmzgdt/e_shop/src/utils"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 type MySQLConnection struct {
-	db *sql.DB
+	sqlStore
 }
 
-func SetupMySQLConnection() (*MySQLConnection, error) {
+func mysqlDSN(params string) string {
 	var (
 		dbname   = utils.GetEnv("MYSQL_DB_NAME", "")
 		user     = utils.GetEnv("MYSQL_USER", "root")
 		password = utils.GetEnv("MYSQL_PASSWORD", "")
 		host     = utils.GetEnv("MYSQL_HOST", "localhost")
 	)
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", user, password, host, dbname)) //host = host.docker.internal for docker dev
-	if err != nil {
-		return nil, err
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", user, password, host, dbname) //host = host.docker.internal for docker dev
+	if params != "" {
+		dsn += "?" + params
 	}
-	fmt.Println("Successful conneciton to MySQL.")
-	return &MySQLConnection{db: db}, nil
+	return dsn
 }
 
-func (s *MySQLConnection) ExecuteQuery(query string, values ...interface{}) (sql.Result, error) {
-	stmt, err := s.db.Prepare(query)
-	defer stmt.Close()
+func SetupMySQLConnection() (*MySQLConnection, error) {
+	db, err := sql.Open("mysql", mysqlDSN(""))
 	if err != nil {
 		return nil, err
 	}
-	result, err := stmt.Exec(values...)
+	fmt.Println("Successful conneciton to MySQL.")
+	return &MySQLConnection{sqlStore{
+		db:         db,
+		dialect:    mysqlDialect{},
+		timeout:    utils.GetEnvDuration("MYSQL_QUERY_TIMEOUT", 5*time.Second),
+		txAttempts: utils.GetEnvInt("MYSQL_TX_ATTEMPTS", 3),
+	}}, nil
+}
+
+//The migrations get a separate connection that allows multiple statements per query; the connection of the API doesn't.
+//Another instance that is migrating is waited for up to MIGRATIONS_LOCK_TIMEOUT.
+func SetupMySQLMigrator() (*migrations.Migrator, error) {
+	db, err := sql.Open("mysql", mysqlDSN("multiStatements=true"))
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	return migrations.New(db, utils.GetEnvDuration("MIGRATIONS_LOCK_TIMEOUT", time.Minute))
 }
 
-func (s *MySQLConnection) GetPassword(query string, values ...interface{}) (string, error) {
-	var password string
+func (s *MySQLConnection) InsertCategory(ctx context.Context, category *items.ItemCategory) (int64, error) {
+	return s.execInsert(ctx, "call add_subcategory(?, ?, ?);", category.Name, category.ParentName, category.UserId)
+}
 
-	err := s.db.QueryRow(query, values...).Scan(&password)
-	if err != nil {
-		return "", err
-	}
-	return password, nil
+func (s *MySQLConnection) DeleteCategory(ctx context.Context, name string) error {
+	_, err := s.exec(ctx, "call delete_category(?);", name)
+	return err
 }
 
-func (s *MySQLConnection) GetUserDetails(query string, values ...interface{}) (*users.UserClaims, error) {
-	userClaims := users.UserClaims{}
-	err := s.db.QueryRow(query, values...).Scan(&userClaims.UserId, &userClaims.Email)
-	if err != nil {
-		return nil, err
-	}
-	return &userClaims, nil
+type mysqlDialect struct{}
+
+func (mysqlDialect) fromUnixTime(arg string) string {
+	return "FROM_UNIXTIME(" + arg + ")"
 }
 
-func (s *MySQLConnection) GetItem(query string, id int) (*items.ItemGet, error) {
-	item := items.ItemGet{}
-	if err := s.db.QueryRow(query, id).Scan(&item.Id, &item.UserId, &item.CategoryId, &item.BrandId, &item.CreatedAt, &item.Price, &item.DiscountedPrice, &item.Description, &item.ModifiedAt); err != nil {
-		return nil, err
-	}
-	return &item, nil
+func (mysqlDialect) unixTimestamp(column string) string {
+	return "UNIX_TIMESTAMP(" + column + ")"
 }
 
-func (s *MySQLConnection) GetItems(query string, limit int) (*[]items.ItemGet, error) {
-	itemsArray := make([]items.ItemGet, 0)
-	rows, err := s.db.Query(query, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		item := new(items.ItemGet)
-		if err := rows.Scan(&item.Id, &item.UserId, &item.CategoryId, &item.BrandId, &item.CreatedAt, &item.Price, &item.DiscountedPrice, &item.Description, &item.ModifiedAt); err != nil {
-			return nil, err
+func (mysqlDialect) now() string {
+	return "NOW()"
+}
+
+func (mysqlDialect) secondsAgo(arg string) string {
+	return "NOW() - INTERVAL " + arg + " SECOND"
+}
+
+func (mysqlDialect) insertIgnore() string {
+	return "INSERT IGNORE"
+}
+
+func (mysqlDialect) translateError(err error, query string) error {
+	var driverError *mysql.MySQLError
+	if errors.As(err, &driverError) {
+		switch driverError.Number {
+		case 1062:
+			return errDuplicate(err)
+		case 1451:
+			return errStillReferenced(err)
+		case 1452:
+			return errReferenceNotFound(err)
+		case 1205, 1213:
+			return errWriteConflict(err)
 		}
-		itemsArray = append(itemsArray, *item)
 	}
-	return &itemsArray, nil
+	return err
+}
+
+//Deadlocks (1213) and lock wait timeouts (1205) roll the transaction back, so it can be run again.
+func (mysqlDialect) isRetryable(err error) bool {
+	var driverError *mysql.MySQLError
+	return errors.As(err, &driverError) && (driverError.Number == 1213 || driverError.Number == 1205)
 }
@@ -2,12 +2,16 @@ package repositories
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/middleware"
 	"github.com/fnmzgdt/e_shop/src/utils"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
 type RedisConnection struct {
@@ -36,16 +40,125 @@ func SetupRedisConnection() (*RedisConnection, error) {
 	return &RedisConnection{client}, nil
 }
 
-func (r *RedisConnection) GetKey(key string) (string, error) {
-	ctx := context.Background()
+func (r *RedisConnection) GetKey(ctx context.Context, key string) (string, error) {
 	result, err := r.client.Get(ctx, key).Result()
 	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", apperrors.New(apperrors.ErrNotFound, "not_found", "The requested resource was not found.", err)
+		}
 		return "", err
 	}
 	return result, nil
 }
 
-func (r *RedisConnection) SetKey(key string, value interface{}, exp time.Duration) error {
-	ctx := context.Background()
+func (r *RedisConnection) SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error {
 	return r.client.Set(ctx, key, value, exp).Err()
 }
+
+const updateKeyAttempts = 5
+
+//The key is watched while update runs, and update runs again if another client changed the key before it was written, so it must not have side effects. The key keeps its TTL.
+func (r *RedisConnection) UpdateKey(ctx context.Context, key string, update func(value string) (string, error)) error {
+	for attempt := 0; attempt < updateKeyAttempts; attempt++ {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.Get(ctx, key).Result()
+			if err != nil {
+				if errors.Is(err, redis.Nil) {
+					return apperrors.New(apperrors.ErrNotFound, "not_found", "The requested resource was not found.", err)
+				}
+				return err
+			}
+			updated, err := update(value)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, updated, redis.KeepTTL)
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return apperrors.New(apperrors.ErrConflict, "write_conflict", "The records are being changed by another request. Please try again.", redis.TxFailedErr)
+}
+
+func (r *RedisConnection) SetKeyNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, value, exp).Result()
+}
+
+func (r *RedisConnection) DeleteKeys(ctx context.Context, keys ...string) (int64, error) {
+	return r.client.Del(ctx, keys...).Result()
+}
+
+func (r *RedisConnection) AddToSet(ctx context.Context, key string, exp time.Duration, members ...interface{}) error {
+	pipe := r.client.TxPipeline()
+	pipe.SAdd(ctx, key, members...)
+	pipe.Expire(ctx, key, exp)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisConnection) GetSetMembers(ctx context.Context, key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+func (r *RedisConnection) RemoveFromSet(ctx context.Context, key string, members ...interface{}) error {
+	return r.client.SRem(ctx, key, members...).Err()
+}
+
+func (r *RedisConnection) GetTTL(ctx context.Context, key string) (time.Duration, error) {
+	return r.client.TTL(ctx, key).Result()
+}
+
+func (r *RedisConnection) AddToSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.UnixNano()), Member: uuid.New().String()})
+	count := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func (r *RedisConnection) CountSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	min := strconv.FormatInt(now.Add(-window).UnixNano(), 10)
+	return r.client.ZCount(ctx, key, "("+min, "+inf").Result()
+}
+
+//The gcraScript runs the GCRA check and update atomically with the clock of the Redis server, so all instances of the API agree on the time. Times are in milliseconds.
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local arrival = tonumber(redis.call("GET", KEYS[1]) or now)
+if arrival < now then
+	arrival = now
+end
+local nextArrival = arrival + interval
+local allowAt = nextArrival - interval * burst
+if allowAt > now then
+	return {0, 0, allowAt - now, arrival - now}
+end
+redis.call("SET", KEYS[1], string.format("%d", nextArrival), "PX", math.max(nextArrival - now, 1))
+return {1, math.floor((now - allowAt) / interval), 0, nextArrival - now}
+`)
+
+func (r *RedisConnection) AllowGCRA(ctx context.Context, key string, interval time.Duration, burst int) (*middleware.RateLimitResult, error) {
+	values, err := gcraScript.Run(ctx, r.client, []string{key}, interval.Milliseconds(), burst).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return &middleware.RateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
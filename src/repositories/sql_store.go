@@ -0,0 +1,173 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+//The dialect holds what differs between the SQL databases the store runs on; the queries of the store are otherwise the same for all of them.
+type dialect interface {
+	fromUnixTime(arg string) string
+	unixTimestamp(column string) string
+	now() string
+	secondsAgo(arg string) string
+	insertIgnore() string
+	translateError(err error, query string) error
+	isRetryable(err error) bool
+}
+
+type sqlStore struct {
+	db         *sql.DB
+	dialect    dialect
+	timeout    time.Duration
+	txAttempts int
+}
+
+type executor interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type txKey struct{}
+
+func errDuplicate(err error) error {
+	return apperrors.New(apperrors.ErrConflict, "duplicate", "A record with the same unique value already exists.", err)
+}
+
+func errStillReferenced(err error) error {
+	return apperrors.New(apperrors.ErrConflict, "still_referenced", "The record is still referenced by other records.", err)
+}
+
+func errReferenceNotFound(err error) error {
+	return apperrors.New(apperrors.ErrValidation, "reference_not_found", "A referenced record does not exist.", err)
+}
+
+func errWriteConflict(err error) error {
+	return apperrors.New(apperrors.ErrConflict, "write_conflict", "The records are being changed by another request. Please try again.", err)
+}
+
+func (s *sqlStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+func (s *sqlStore) conn(ctx context.Context) executor {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+func (s *sqlStore) error(err error, query string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return apperrors.New(apperrors.ErrNotFound, "not_found", "The requested resource was not found.", err)
+	}
+	return s.dialect.translateError(err, query)
+}
+
+//The queries fn runs with the context it is given join the transaction; a nested call joins the outer one.
+//A transaction that conflicts with another one, e.g. on a deadlock or a lock wait timeout, is retried from the start up to txAttempts times, so fn must not have side effects outside the database it can't repeat.
+func (s *sqlStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.runTransaction(ctx, fn)
+		if err == nil || !s.dialect.isRetryable(err) || attempt >= s.txAttempts {
+			return err
+		}
+		backoff := time.Duration(attempt*attempt)*20*time.Millisecond + time.Duration(rand.Int63n(int64(20*time.Millisecond)))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *sqlStore) runTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return s.error(err, "BEGIN")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return s.error(tx.Commit(), "COMMIT")
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, values ...interface{}) (sql.Result, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	stmt, err := s.conn(ctx).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, s.error(err, query)
+	}
+	defer stmt.Close()
+	result, err := stmt.ExecContext(ctx, values...)
+	if err != nil {
+		return nil, s.error(err, query)
+	}
+	return result, nil
+}
+
+func (s *sqlStore) execRowsAffected(ctx context.Context, query string, values ...interface{}) (int64, error) {
+	result, err := s.exec(ctx, query, values...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) execInsert(ctx context.Context, query string, values ...interface{}) (int64, error) {
+	result, err := s.exec(ctx, query, values...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (s *sqlStore) scanRow(ctx context.Context, query string, values []interface{}, dest ...interface{}) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.error(s.conn(ctx).QueryRowContext(ctx, query, values...).Scan(dest...), query)
+}
+
+func (s *sqlStore) scanRows(ctx context.Context, query string, values []interface{}, scan func(rows *sql.Rows) error) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.conn(ctx).QueryContext(ctx, query, values...)
+	if err != nil {
+		return s.error(err, query)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return s.error(err, query)
+		}
+	}
+	return s.error(rows.Err(), query)
+}
+
+func (s *sqlStore) exists(ctx context.Context, query string, values ...interface{}) (bool, error) {
+	var exists bool
+	if err := s.scanRow(ctx, query, values, &exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
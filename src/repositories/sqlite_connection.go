@@ -0,0 +1,143 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/items"
+	"github.com/fnmzgdt/e_shop/src/migrations"
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+const rootCategory = "all"
+
+//SQLite allows a single writer, so the connection pool is limited to one connection; this also keeps an in-memory database alive between queries.
+type SQLiteConnection struct {
+	sqlStore
+}
+
+func openSQLite() (*sql.DB, error) {
+	path := utils.GetEnv("SQLITE_PATH", "e_shop.db")
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("%w (is the server built with -tags sqlite?)", err)
+	}
+	return db, nil
+}
+
+func SetupSQLiteConnection() (*SQLiteConnection, error) {
+	db, err := openSQLite()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := newSQLiteConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Successful conneciton to SQLite.")
+	return conn, nil
+}
+
+func SetupSQLiteMigrator() (*migrations.Migrator, error) {
+	db, err := openSQLite()
+	if err != nil {
+		return nil, err
+	}
+	return migrations.NewSQLite(db)
+}
+
+func newSQLiteConnection(db *sql.DB) (*SQLiteConnection, error) {
+	db.SetMaxOpenConns(1)
+	migrator, err := migrations.NewSQLite(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(context.Background(), 0); err != nil {
+		return nil, err
+	}
+	return &SQLiteConnection{sqlStore{
+		db:         db,
+		dialect:    sqliteDialect{},
+		timeout:    utils.GetEnvDuration("SQLITE_QUERY_TIMEOUT", 5*time.Second),
+		txAttempts: utils.GetEnvInt("SQLITE_TX_ATTEMPTS", 3),
+	}}, nil
+}
+
+//This does what the add_subcategory procedure does in MySQL.
+func (s *SQLiteConnection) InsertCategory(ctx context.Context, category *items.ItemCategory) (int64, error) {
+	var id int64
+	err := s.InTransaction(ctx, func(ctx context.Context) error {
+		var parentId int64
+		if err := s.scanRow(ctx, "SELECT id FROM categories WHERE name = ?;", []interface{}{category.ParentName}, &parentId); err != nil {
+			if errors.Is(err, apperrors.ErrNotFound) {
+				return errReferenceNotFound(err)
+			}
+			return err
+		}
+		var err error
+		id, err = s.execInsert(ctx, "INSERT INTO categories(name, parent_id, user_id) VALUES (?, ?, ?);", category.Name, parentId, category.UserId)
+		return err
+	})
+	return id, err
+}
+
+//The foreign key deletes the subcategories.
+func (s *SQLiteConnection) DeleteCategory(ctx context.Context, name string) error {
+	if name == rootCategory {
+		return errStillReferenced(errors.New("the root category can not be deleted"))
+	}
+	_, err := s.exec(ctx, "DELETE FROM categories WHERE name = ?;", name)
+	return err
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) fromUnixTime(arg string) string {
+	return "datetime(" + arg + ", 'unixepoch')"
+}
+
+func (sqliteDialect) unixTimestamp(column string) string {
+	return "CAST(strftime('%s', " + column + ") AS INTEGER)"
+}
+
+func (sqliteDialect) now() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (sqliteDialect) secondsAgo(arg string) string {
+	return "datetime('now', '-' || " + arg + " || ' seconds')"
+}
+
+func (sqliteDialect) insertIgnore() string {
+	return "INSERT OR IGNORE"
+}
+
+//SQLite errors are recognized by their messages, which are the same with every driver. A failed foreign key check of a DELETE means the row is still referenced, of other statements that the referenced row is missing.
+func (sqliteDialect) translateError(err error, query string) error {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "UNIQUE constraint failed"):
+		return errDuplicate(err)
+	case strings.Contains(message, "FOREIGN KEY constraint failed"):
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "DELETE") {
+			return errStillReferenced(err)
+		}
+		return errReferenceNotFound(err)
+	case isSQLiteBusy(err):
+		return errWriteConflict(err)
+	}
+	return err
+}
+
+func (sqliteDialect) isRetryable(err error) bool {
+	return isSQLiteBusy(err)
+}
+
+func isSQLiteBusy(err error) bool {
+	return strings.Contains(err.Error(), "database is locked") || strings.Contains(err.Error(), "database table is locked")
+}
@@ -0,0 +1,358 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/items"
+	"github.com/fnmzgdt/e_shop/src/users"
+	_ "modernc.org/sqlite"
+)
+
+func newTestStore(t *testing.T) *SQLiteConnection {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file::memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := newSQLiteConnection(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestUser(t *testing.T, s *SQLiteConnection, email string) string {
+	t.Helper()
+	userId, err := s.InsertUser(context.Background(), email, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userId
+}
+
+func errorCode(err error) string {
+	var appErr *apperrors.Error
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+	return ""
+}
+
+func TestItemVersions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "owner@example.com")
+	uid, _ := strconv.Atoi(userId)
+	brandId, err := s.InsertBrand(ctx, &items.Brand{Name: "brand", UserId: userId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.InsertItem(ctx, &items.ItemPost{UserId: uid, CategoryId: 1, BrandId: int(brandId), CreatedAt: 1600000000, Price: 100, DiscountedPrice: 90, Description: "shoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.GetItem(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.CreatedAt != 1600000000 || item.Price != 100 || item.DiscountedPrice != 90 || item.Version != 1 {
+		t.Errorf("inserted item %+v", *item)
+	}
+
+	current, err := s.GetItemDocument(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := *current
+	patched.Price = 120
+	patched.DiscountedPrice = nil
+	if n, err := s.PatchItem(ctx, current, &patched, 1700000000); err != nil || n != 1 {
+		t.Fatalf("patch updated %d rows: %v", n, err)
+	}
+	if n, err := s.PatchItem(ctx, current, &patched, 1700000000); err != nil || n != 0 {
+		t.Fatalf("patch of a stale version updated %d rows: %v", n, err)
+	}
+	item, err = s.GetItem(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Price != 120 || item.DiscountedPrice != 0 || item.ModifiedAt != 1700000000 || item.Version != 2 {
+		t.Errorf("patched item %+v", *item)
+	}
+
+	deletedAt := 1700000001
+	current, _ = s.GetItemDocument(ctx, id)
+	patched = *current
+	patched.DeletedAt = &deletedAt
+	if _, err := s.PatchItem(ctx, current, &patched, deletedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetItem(ctx, id); errorCode(err) != "not_found" {
+		t.Errorf("get of a soft deleted item: %v", err)
+	}
+	if exists, err := s.ItemExists(ctx, strconv.Itoa(id)); err != nil || exists {
+		t.Errorf("soft deleted item exists: %v %v", exists, err)
+	}
+
+	if n, err := s.DeleteItem(ctx, id, 1); err != nil || n != 0 {
+		t.Errorf("delete of a stale version deleted %d rows: %v", n, err)
+	}
+	if n, err := s.DeleteItem(ctx, id, 3); err != nil || n != 1 {
+		t.Errorf("delete deleted %d rows: %v", n, err)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "owner@example.com")
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "shoes", ParentName: "all", UserId: userId}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "boots", ParentName: "shoes", UserId: userId}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "hats", ParentName: "missing", UserId: userId}); !errors.Is(err, apperrors.ErrValidation) {
+		t.Errorf("insert under a missing parent: %v", err)
+	}
+	if _, err := s.InsertCategory(ctx, &items.ItemCategory{Name: "shoes", ParentName: "all", UserId: userId}); errorCode(err) != "duplicate" {
+		t.Errorf("insert of a duplicate name: %v", err)
+	}
+	if err := s.DeleteCategory(ctx, "all"); !errors.Is(err, apperrors.ErrConflict) {
+		t.Errorf("delete of the root: %v", err)
+	}
+	if err := s.DeleteCategory(ctx, "shoes"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := s.CategoryExists(ctx, 3); err != nil || exists {
+		t.Errorf("subcategory of a deleted category exists: %v %v", exists, err)
+	}
+}
+
+func TestBatchInserts(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "owner@example.com")
+	if _, err := s.exec(ctx, "INSERT INTO sizes(name, user_id) VALUES ('xs', ?);", userId); err != nil {
+		t.Fatal(err)
+	}
+	sizes := []items.Size{{Name: "s", UserId: userId}, {Name: "m", UserId: userId}}
+	if err := s.InTransaction(ctx, func(ctx context.Context) error { return s.InsertSizes(ctx, sizes) }); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range sizes {
+		var name string
+		if err := s.scanRow(ctx, "SELECT name FROM sizes WHERE id = ?;", []interface{}{size.Id}, &name); err != nil || name != size.Name {
+			t.Errorf("size %+v has the id of %q: %v", size, name, err)
+		}
+	}
+
+	locations := make([]items.Location, insertBatchSize+2)
+	for i := range locations {
+		locations[i] = items.Location{Address: strconv.Itoa(i % 3), UserId: userId}
+	}
+	if err := s.InTransaction(ctx, func(ctx context.Context) error { return s.InsertLocations(ctx, locations) }); err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range locations {
+		var address string
+		if err := s.scanRow(ctx, "SELECT address FROM locations WHERE id = ?;", []interface{}{location.Id}, &address); err != nil || address != location.Address || (i > 0 && location.Id <= locations[i-1].Id) {
+			t.Fatalf("location %d %+v has the id of %q: %v", i, location, address, err)
+		}
+	}
+
+	duplicate := []items.Size{{Name: "l", UserId: userId}, {Name: "s", UserId: userId}}
+	err := s.InTransaction(ctx, func(ctx context.Context) error { return s.InsertSizes(ctx, duplicate) })
+	if errorCode(err) != "duplicate" {
+		t.Errorf("insert of a duplicate size: %v", err)
+	}
+	var count int
+	if err := s.scanRow(ctx, "SELECT COUNT(*) FROM sizes;", nil, &count); err != nil || count != 3 {
+		t.Errorf("%d sizes after a failed batch: %v", count, err)
+	}
+
+	rows := make([][]interface{}, insertBatchSize+2)
+	for i := range rows {
+		rows[i] = []interface{}{userId, strconv.Itoa(i)}
+	}
+	if err := s.insertRows(ctx, "INSERT INTO user_recovery_codes(user_id, code_hash)", "(?, ?)", rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scanRow(ctx, "SELECT COUNT(*) FROM user_recovery_codes;", nil, &count); err != nil || count != len(rows) {
+		t.Errorf("%d of %d rows inserted: %v", count, len(rows), err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "owner@example.com")
+	uid, _ := strconv.Atoi(userId)
+	locations := []items.Location{{Address: "1 Main St", UserId: userId}}
+	if err := s.InsertLocations(ctx, locations); err != nil {
+		t.Fatal(err)
+	}
+	brandId, err := s.InsertBrand(ctx, &items.Brand{Name: "brand", UserId: userId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemId, err := s.InsertItem(ctx, &items.ItemPost{UserId: uid, CategoryId: 1, BrandId: int(brandId), CreatedAt: 1600000000, Price: 100, Description: "shoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.exec(ctx, "DELETE FROM brands WHERE id = ?;", brandId); errorCode(err) != "still_referenced" {
+		t.Errorf("delete of a referenced brand: %v", err)
+	}
+
+	discounts := []items.Discount{{Code: "SALE", Amount: "10%", ExpiresAt: 1900000000, UserId: userId}}
+	if err := s.InsertDiscounts(ctx, discounts); err != nil {
+		t.Fatal(err)
+	}
+	discountId := strconv.Itoa(discounts[0].Id)
+	missing := []items.ItemDiscount{{ItemId: "999", DiscountId: discountId, ValidAt: 1800000000}}
+	if err := s.InsertItemDiscounts(ctx, missing); errorCode(err) != "reference_not_found" {
+		t.Errorf("discount of a missing item: %v", err)
+	}
+	valid := []items.ItemDiscount{{ItemId: strconv.Itoa(itemId), DiscountId: discountId, ValidAt: 1800000000}}
+	if err := s.InsertItemDiscounts(ctx, valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteDiscounts(ctx, discounts); err != nil {
+		t.Errorf("delete of a discount in use: %v", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "user@example.com")
+	if _, err := s.InsertUser(ctx, "user@example.com", "hash"); errorCode(err) != "duplicate" {
+		t.Errorf("insert of a taken email: %v", err)
+	}
+	accountId, err := s.InsertServiceAccount(ctx, "robot@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{userId: false, accountId: true} {
+		if serviceAccount, err := s.IsServiceAccount(ctx, id); err != nil || serviceAccount != want {
+			t.Errorf("user %s is a service account: %v %v", id, serviceAccount, err)
+		}
+	}
+	if _, err := s.IsServiceAccount(ctx, "999"); !errors.Is(err, apperrors.ErrNotFound) {
+		t.Errorf("missing user: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.InsertRole(ctx, userId, "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.InsertRole(ctx, "999", "admin"); !errors.Is(err, apperrors.ErrValidation) {
+		t.Errorf("role of a missing user: %v", err)
+	}
+	if roles, err := s.GetRoles(ctx, userId); err != nil || len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("roles %v: %v", roles, err)
+	}
+	if err := s.DeleteRole(ctx, userId, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := s.GetRoles(ctx, userId); err != nil || len(roles) != 0 {
+		t.Errorf("roles after the delete %v: %v", roles, err)
+	}
+
+	if err := s.InsertIdentity(ctx, &users.ExternalIdentity{Provider: "google", Subject: "42"}, userId, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.GetIdentityUserId(ctx, "google", "42"); err != nil || id != userId {
+		t.Errorf("identity of user %s: %v", id, err)
+	}
+	if _, err := s.GetIdentityUserId(ctx, "google", "43"); !errors.Is(err, apperrors.ErrNotFound) {
+		t.Errorf("missing identity: %v", err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	ownerId := newTestUser(t, s, "owner@example.com")
+	otherId := newTestUser(t, s, "other@example.com")
+	key := users.APIKey{UserId: ownerId, Name: "ci", Permissions: []string{"items:write", "prices:write"}, AllowedIPs: []string{"10.0.0.0/8"}, ExpiresAt: 1900000000}
+	keyId, err := s.InsertAPIKey(ctx, &key, "abcd1234", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.GetAPIKeys(ctx, ownerId)
+	if err != nil || len(*keys) != 1 {
+		t.Fatalf("keys %v: %v", keys, err)
+	}
+	got := (*keys)[0]
+	if got.Id != keyId || got.Prefix != "abcd1234" || len(got.Permissions) != 2 || len(got.AllowedIPs) != 1 || got.ExpiresAt != 1900000000 || got.CreatedAt == 0 || got.LastUsedAt != 0 {
+		t.Errorf("key %+v", got)
+	}
+
+	credentials, err := s.GetAPIKeyCredentials(ctx, "abcd1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.UserId != ownerId || credentials.Email != "owner@example.com" || credentials.KeyHash != "hash" || credentials.ExpiresAt != 1900000000 || credentials.Revoked {
+		t.Errorf("credentials %+v", *credentials)
+	}
+	if err := s.TouchAPIKey(ctx, keyId, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = s.GetAPIKeys(ctx, ownerId)
+	if (*keys)[0].LastUsedAt == 0 {
+		t.Error("the use of the key was not recorded")
+	}
+
+	if n, err := s.RevokeAPIKey(ctx, keyId, otherId); err != nil || n != 0 {
+		t.Errorf("revoke by another user revoked %d keys: %v", n, err)
+	}
+	if n, err := s.RevokeAPIKey(ctx, keyId, ownerId); err != nil || n != 1 {
+		t.Errorf("revoke revoked %d keys: %v", n, err)
+	}
+	if credentials, err := s.GetAPIKeyCredentials(ctx, "abcd1234"); err != nil || !credentials.Revoked {
+		t.Errorf("revoked key %+v: %v", credentials, err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	userId := newTestUser(t, s, "user@example.com")
+	if err := s.SetTOTPSecret(ctx, userId, "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := s.GetTOTPSecret(ctx, userId); err != nil || secret != "SECRET" {
+		t.Errorf("secret %q: %v", secret, err)
+	}
+	if err := s.ReplaceRecoveryCodes(ctx, userId, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := s.UseRecoveryCode(ctx, userId, "a"); err != nil || !used {
+		t.Errorf("first use of a code: %v %v", used, err)
+	}
+	if used, err := s.UseRecoveryCode(ctx, userId, "a"); err != nil || used {
+		t.Errorf("second use of a code: %v %v", used, err)
+	}
+	if err := s.ReplaceRecoveryCodes(ctx, userId, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := s.UseRecoveryCode(ctx, userId, "b"); err != nil || used {
+		t.Errorf("use of a replaced code: %v %v", used, err)
+	}
+
+	if err := s.SetTOTPSecret(ctx, userId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := s.GetTOTPSecret(ctx, userId); err != nil || secret != "" {
+		t.Errorf("removed secret %q: %v", secret, err)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package repositories
+
+//The SQLite driver is a large pure Go translation of SQLite, so it is only linked into builds with the sqlite tag: go build -tags sqlite, and DB_DRIVER=sqlite to use it.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,205 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/middleware"
+	"github.com/fnmzgdt/e_shop/src/users"
+)
+
+func (s *sqlStore) InsertUser(ctx context.Context, email string, password string) (string, error) {
+	id, err := s.execInsert(ctx, "INSERT INTO users(email, password) VALUES (?, ?);", email, password)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (s *sqlStore) InsertServiceAccount(ctx context.Context, email string) (string, error) {
+	id, err := s.execInsert(ctx, "INSERT INTO users(email, password, service_account) VALUES (?, '', TRUE);", email)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (s *sqlStore) IsServiceAccount(ctx context.Context, userId string) (bool, error) {
+	var serviceAccount bool
+	if err := s.scanRow(ctx, "SELECT service_account FROM users WHERE id = ?;", []interface{}{userId}, &serviceAccount); err != nil {
+		return false, err
+	}
+	return serviceAccount, nil
+}
+
+func (s *sqlStore) GetPassword(ctx context.Context, email string) (string, error) {
+	var password string
+	if err := s.scanRow(ctx, "SELECT password FROM users WHERE email = ?;", []interface{}{email}, &password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+func (s *sqlStore) GetUserClaimsByEmail(ctx context.Context, email string) (*users.UserClaims, error) {
+	claims := users.UserClaims{}
+	if err := s.scanRow(ctx, "SELECT id, email FROM users WHERE email = ?;", []interface{}{email}, &claims.UserId, &claims.Email); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (s *sqlStore) GetUserClaimsById(ctx context.Context, userId string) (*users.UserClaims, error) {
+	claims := users.UserClaims{}
+	if err := s.scanRow(ctx, "SELECT id, email FROM users WHERE id = ?;", []interface{}{userId}, &claims.UserId, &claims.Email); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (s *sqlStore) GetUserIdByEmail(ctx context.Context, email string) (string, error) {
+	var userId string
+	if err := s.scanRow(ctx, "SELECT id FROM users WHERE email = ?;", []interface{}{email}, &userId); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (s *sqlStore) GetRoles(ctx context.Context, userId string) ([]string, error) {
+	roles := make([]string, 0)
+	err := s.scanRows(ctx, "SELECT role FROM user_roles WHERE user_id = ? ORDER BY role;", []interface{}{userId}, func(rows *sql.Rows) error {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return err
+		}
+		roles = append(roles, role)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s *sqlStore) InsertRole(ctx context.Context, userId string, role string) error {
+	_, err := s.exec(ctx, s.dialect.insertIgnore()+" INTO user_roles(user_id, role) VALUES (?, ?);", userId, role)
+	return err
+}
+
+func (s *sqlStore) DeleteRole(ctx context.Context, userId string, role string) error {
+	_, err := s.exec(ctx, "DELETE FROM user_roles WHERE user_id = ? AND role = ?;", userId, role)
+	return err
+}
+
+func (s *sqlStore) InsertAPIKey(ctx context.Context, apiKey *users.APIKey, prefix string, hash string) (string, error) {
+	var expiresAt, allowedIPs interface{}
+	if apiKey.ExpiresAt != 0 {
+		expiresAt = apiKey.ExpiresAt
+	}
+	if len(apiKey.AllowedIPs) != 0 {
+		allowedIPs = strings.Join(apiKey.AllowedIPs, ",")
+	}
+	query := fmt.Sprintf("INSERT INTO api_keys(user_id, name, prefix, key_hash, permissions, allowed_ips, expires_at) VALUES (?, ?, ?, ?, ?, ?, %s);", s.dialect.fromUnixTime("?"))
+	id, err := s.execInsert(ctx, query, apiKey.UserId, apiKey.Name, prefix, hash, strings.Join(apiKey.Permissions, ","), allowedIPs, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (s *sqlStore) GetAPIKeys(ctx context.Context, userId string) (*[]users.APIKey, error) {
+	query := fmt.Sprintf("SELECT id, user_id, name, prefix, permissions, COALESCE(allowed_ips, ''), COALESCE(%s, 0), COALESCE(%s, 0), %s, COALESCE(%s, 0) FROM api_keys WHERE user_id = ? ORDER BY created_at DESC;",
+		s.dialect.unixTimestamp("expires_at"), s.dialect.unixTimestamp("last_used_at"), s.dialect.unixTimestamp("created_at"), s.dialect.unixTimestamp("revoked_at"))
+	keys := make([]users.APIKey, 0)
+	err := s.scanRows(ctx, query, []interface{}{userId}, func(rows *sql.Rows) error {
+		key := users.APIKey{}
+		var permissions, allowedIPs string
+		if err := rows.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &permissions, &allowedIPs, &key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return err
+		}
+		key.Permissions = strings.Split(permissions, ",")
+		if allowedIPs != "" {
+			key.AllowedIPs = strings.Split(allowedIPs, ",")
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, keyId string, ownerId string) (int64, error) {
+	query := fmt.Sprintf("UPDATE api_keys SET revoked_at = %s WHERE id = ? AND revoked_at IS NULL AND (? = '' OR user_id = ?);", s.dialect.now())
+	return s.execRowsAffected(ctx, query, keyId, ownerId, ownerId)
+}
+
+func (s *sqlStore) GetAPIKeyCredentials(ctx context.Context, prefix string) (*middleware.APIKeyCredentials, error) {
+	query := fmt.Sprintf("SELECT k.id, k.user_id, u.email, k.key_hash, k.permissions, COALESCE(k.allowed_ips, ''), COALESCE(%s, 0), k.revoked_at IS NOT NULL FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.prefix = ?;", s.dialect.unixTimestamp("k.expires_at"))
+	credentials := middleware.APIKeyCredentials{}
+	if err := s.scanRow(ctx, query, []interface{}{prefix}, &credentials.Id, &credentials.UserId, &credentials.Email, &credentials.KeyHash, &credentials.Permissions, &credentials.AllowedIPs, &credentials.ExpiresAt, &credentials.Revoked); err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+func (s *sqlStore) TouchAPIKey(ctx context.Context, keyId string, resolution time.Duration) error {
+	query := fmt.Sprintf("UPDATE api_keys SET last_used_at = %s WHERE id = ? AND (last_used_at IS NULL OR last_used_at < %s);", s.dialect.now(), s.dialect.secondsAgo("?"))
+	_, err := s.exec(ctx, query, keyId, int(resolution.Seconds()))
+	return err
+}
+
+func (s *sqlStore) GetTOTPSecret(ctx context.Context, userId string) (string, error) {
+	var secret string
+	if err := s.scanRow(ctx, "SELECT COALESCE(totp_secret, '') FROM users WHERE id = ?;", []interface{}{userId}, &secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (s *sqlStore) SetTOTPSecret(ctx context.Context, userId string, secret string) error {
+	_, err := s.exec(ctx, "UPDATE users SET totp_secret = NULLIF(?, '') WHERE id = ?;", secret, userId)
+	return err
+}
+
+func (s *sqlStore) ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error {
+	return s.InTransaction(ctx, func(ctx context.Context) error {
+		if _, err := s.exec(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ?;", userId); err != nil {
+			return err
+		}
+		if len(codeHashes) == 0 {
+			return nil
+		}
+		rows := make([][]interface{}, len(codeHashes))
+		for i, hash := range codeHashes {
+			rows[i] = []interface{}{userId, hash}
+		}
+		return s.insertRows(ctx, "INSERT INTO user_recovery_codes(user_id, code_hash)", "(?, ?)", rows)
+	})
+}
+
+func (s *sqlStore) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	query := fmt.Sprintf("UPDATE user_recovery_codes SET used_at = %s WHERE user_id = ? AND code_hash = ? AND used_at IS NULL;", s.dialect.now())
+	rowsAffected, err := s.execRowsAffected(ctx, query, userId, codeHash)
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected != 0, nil
+}
+
+func (s *sqlStore) GetIdentityUserId(ctx context.Context, provider string, subject string) (string, error) {
+	var userId string
+	if err := s.scanRow(ctx, "SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?;", []interface{}{provider, subject}, &userId); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (s *sqlStore) InsertIdentity(ctx context.Context, identity *users.ExternalIdentity, userId string, email string) error {
+	_, err := s.exec(ctx, "INSERT INTO user_identities(provider, subject, user_id, email) VALUES (?, ?, ?, ?);", identity.Provider, identity.Subject, userId, email)
+	return err
+}
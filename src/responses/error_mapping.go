@@ -0,0 +1,46 @@
+package responses
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+var errorStatuses = []struct {
+	kind   error
+	status int
+}{
+	{apperrors.ErrNotFound, http.StatusNotFound},
+	{apperrors.ErrConflict, http.StatusConflict},
+	{apperrors.ErrValidation, http.StatusBadRequest},
+	{apperrors.ErrUnauthorized, http.StatusUnauthorized},
+	{apperrors.ErrForbidden, http.StatusForbidden},
+	{apperrors.ErrPreconditionFailed, http.StatusPreconditionFailed},
+}
+
+//Errors that aren't domain errors are logged and answered with a generic 500, so database and Redis errors never reach clients.
+//Requests that ran out of time get a 503; requests the client cancelled get no response, since nobody reads it.
+func Error(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("timeout: %s %s: %v", r.Method, r.URL.Path, err)
+		WriteProblem(w, Problem{Status: http.StatusServiceUnavailable, Detail: "The request took too long. Please try again later.", Code: "timeout", Instance: r.URL.Path})
+		return
+	}
+	var domainError *apperrors.Error
+	if errors.As(err, &domainError) {
+		for _, errorStatus := range errorStatuses {
+			if errors.Is(domainError, errorStatus.kind) {
+				WriteProblem(w, Problem{Status: errorStatus.status, Detail: domainError.Message, Code: domainError.Code, Errors: domainError.Fields, Instance: r.URL.Path})
+				return
+			}
+		}
+	}
+	log.Printf("internal error: %s %s: %v", r.Method, r.URL.Path, err)
+	WriteProblem(w, Problem{Status: http.StatusInternalServerError, Detail: "Something went wrong. Please try again later.", Code: "internal_error", Instance: r.URL.Path})
+}
@@ -0,0 +1,30 @@
+package responses
+
+import (
+	"fmt"
+	"strings"
+)
+
+func ETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+//If-Match uses the strong comparison, so weak tags never match it; If-None-Match uses the weak one and passes weak as true.
+func ETagMatches(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
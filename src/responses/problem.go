@@ -0,0 +1,45 @@
+package responses
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/utils"
+)
+
+//The Problem is an RFC 7807 error response. Besides the standard members it has the stable error code and the invalid fields of validation errors.
+//The success, message and payload members are those of the JSON responses, so clients that read them keep working.
+type Problem struct {
+	Type     string                 `json:"type"`
+	Title    string                 `json:"title"`
+	Status   int                    `json:"status"`
+	Detail   string                 `json:"detail,omitempty"`
+	Instance string                 `json:"instance,omitempty"`
+	Code     string                 `json:"code,omitempty"`
+	Errors   []apperrors.FieldError `json:"errors,omitempty"`
+	Success  int                    `json:"success"`
+	Message  string                 `json:"message"`
+	Payload  []int                  `json:"payload"`
+}
+
+//Without PROBLEM_TYPE_BASE_URL every problem has the type about:blank, which means the status says it all.
+func problemType(code string) string {
+	base := utils.GetEnv("PROBLEM_TYPE_BASE_URL", "")
+	if base == "" || code == "" {
+		return "about:blank"
+	}
+	return base + code
+}
+
+func WriteProblem(w http.ResponseWriter, problem Problem) {
+	problem.Type = problemType(problem.Code)
+	problem.Title = http.StatusText(problem.Status)
+	problem.Message = problem.Detail
+	problem.Payload = make([]int, 0)
+	response, _ := json.Marshal(problem)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	w.Write(response)
+}
@@ -1,11 +1,13 @@
 package router
 
 import (
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/fnmzgdt/e_shop/src/items"
+	"github.com/fnmzgdt/e_shop/src/mailer"
 	"github.com/fnmzgdt/e_shop/src/middleware"
 	"github.com/fnmzgdt/e_shop/src/repositories"
 	"github.com/fnmzgdt/e_shop/src/users"
@@ -13,13 +15,34 @@ import (
 	"github.com/go-chi/chi"
 )
 
+type rdbms interface {
+	items.Rdbms
+	users.Rdbms
+	middleware.Rdbms
+}
+
+func setupRdbms() (rdbms, error) {
+	switch driver := utils.GetEnv("DB_DRIVER", "mysql"); driver {
+	case "mysql":
+		return repositories.SetupMySQLConnection()
+	case "sqlite":
+		return repositories.SetupSQLiteConnection()
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q: use mysql or sqlite", driver)
+	}
+}
+
 func StartServer() *chi.Mux {
 	var (
 		port = utils.GetEnv("PORT", "8000")
 		host = utils.GetEnv("DOCKER_HOST", "127.0.0.1")
 	)
 
-	mysql, err := repositories.SetupMySQLConnection()
+	if err := middleware.SetupKeySet(); err != nil {
+		log.Fatal(err)
+	}
+
+	rdbms, err := setupRdbms()
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -28,15 +51,34 @@ func StartServer() *chi.Mux {
 		fmt.Println(err)
 	}
 
-	postsService := items.NewPostsService(mysql)
-	usersService := users.NewUserssService(mysql, redis)
-	middlewareController := middleware.NewMIddlewareController(redis)
+	postsService := items.NewPostsService(rdbms)
+	if utils.GetEnvBool("ITEMS_CACHE_ENABLED", true) {
+		postsService = items.NewCachedService(postsService, redis, items.NewCacheConfig())
+	}
+	usersService := users.NewUserssService(rdbms, redis, middleware.NewMiddlewareService(redis, rdbms), mailer.SetupMailer())
+	var rateLimits middleware.RateLimitStore = redis
+	if utils.GetEnv("RATE_LIMIT_STORE", "redis") == "memory" {
+		rateLimits = nil
+	}
+	middlewareController := middleware.NewMIddlewareController(redis, rdbms, rateLimits)
+
+	//the storefront may call the public routes; the admin routes can be limited to the admin frontend with the CORS_ADMIN_* variables
+	publicCORS := middleware.NewCORSPolicy("CORS", nil)
+	adminCORS := middleware.NewCORSPolicy("CORS_ADMIN", publicCORS)
+	var corsOverrides []middleware.CORSOverride
+	for _, path := range []string{"/api/items/category", "/api/items/brand", "/api/items/size", "/api/items/location", "/api/items/discount", "/api/items/applydiscount", "/api/users/roles", "/api/users/lockouts", "/api/users/service-accounts", "/api/users/apikeys"} {
+		corsOverrides = append(corsOverrides, middleware.CORSOverride{PathPrefix: path, Policy: adminCORS})
+	}
 
 	router := chi.NewRouter()
 
+	router.Use(middlewareController.CORS(publicCORS, corsOverrides...))
 	router.Use(middlewareController.Serialize)
+	router.Use(middlewareController.CSRFProtect())
+	router.Get("/.well-known/jwks.json", middlewareController.GetJWKS)
+	router.With(middlewareController.RequirePermission(middleware.UsersManage)).Get("/debug/vars", expvar.Handler().ServeHTTP)
 	router.Mount("/api/items", items.PostsRoutes(postsService, middlewareController))
-	router.Mount("/api/users", users.UsersRoutes(usersService))
+	router.Mount("/api/users", users.UsersRoutes(usersService, middlewareController))
 	router.Mount("/api/middleware", middleware.MiddlewareRoutes(middlewareController))
 
 	fmt.Println("Server is listening on PORT " + port + ".")
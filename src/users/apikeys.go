@@ -0,0 +1,67 @@
+package users
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/middleware"
+)
+
+func (s *service) CreateServiceAccount(ctx context.Context, account *ServiceAccount) (string, error) {
+	userId, err := s.rdbms.InsertServiceAccount(ctx, account.Email)
+	if err != nil {
+		return "", emailTakenError(err)
+	}
+	return userId, nil
+}
+
+func (s *service) IsServiceAccount(ctx context.Context, userId string) (bool, error) {
+	serviceAccount, err := s.rdbms.IsServiceAccount(ctx, userId)
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return serviceAccount, nil
+}
+
+var ErrAPIKeyRequiresMFA = apperrors.Forbidden("api_key_mfa_role", "Users with roles that require two-factor authentication can't have API keys.")
+
+//Owners with a role in MFA_REQUIRED_ROLES are refused, since the permissions of that role could never be used with the key.
+func (s *service) CreateAPIKey(ctx context.Context, apiKey *APIKey) (*APIKey, error) {
+	roles, err := s.getRoles(ctx, apiKey.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if middleware.RequiresMFA(roles) {
+		return nil, ErrAPIKeyRequiresMFA
+	}
+	key, prefix, hash, err := middleware.NewAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.rdbms.InsertAPIKey(ctx, apiKey, prefix, hash)
+	if err != nil {
+		return nil, err
+	}
+	created := *apiKey
+	created.Id = id
+	created.Prefix = prefix
+	created.Key = key
+	return &created, nil
+}
+
+func (s *service) GetAPIKeys(ctx context.Context, userId string) (*[]APIKey, error) {
+	return s.rdbms.GetAPIKeys(ctx, userId)
+}
+
+//With an empty owner any key can be revoked.
+func (s *service) RevokeAPIKey(ctx context.Context, keyId string, ownerId string) (int, error) {
+	rowsAffected, err := s.rdbms.RevokeAPIKey(ctx, keyId, ownerId)
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
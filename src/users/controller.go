@@ -2,12 +2,19 @@ package users
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fnmzgdt/e_shop/src/apperrors"
 	"github.com/fnmzgdt/e_shop/src/middleware"
 	"github.com/fnmzgdt/e_shop/src/responses"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/go-chi/chi"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -23,109 +30,621 @@ func registerUser(s Service) func(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewDecoder(r.Body).Decode(&user)
 
 		if err := user.checkFields(); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			responses.Error(w, r, err)
 			return
 		}
 		password, err := bcrypt.GenerateFromPassword([]byte(user.Password), 11)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		user.Password = string(password[:])
-		userId, err := s.InsertUser(&user)
+		userId, err := s.InsertUser(r.Context(), &user)
 		if err != nil {
-			if strings.Split(err.Error(), ":")[0] == "Error 1062" {
-				responses.JSONError(w, "An account with this email already exists.", http.StatusInternalServerError)
-				return
-			}
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
 		user.Password = ""
 		claims := user.createClaims(userId)
-		refreshToken, err := middleware.NewJWT(time.Hour*24*356, map[string]interface{}{"sessionId": claims.SessionUUID, "userId": claims.UserId})
+		if err := startSession(s, w, r, &claims); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Successful registration.", []User{user}, 200)
+		return
+	}
+}
+
+func login(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			responses.JSONError(w, "Method type not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		userLogin := UserLogin{}
+		_ = json.NewDecoder(r.Body).Decode(&userLogin)
+		ip := utils.ClientIP(r)
+		lockedFor, err := s.LoginLockedFor(r.Context(), userLogin.Email, ip)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
+			return
+		}
+		if lockedFor > 0 {
+			tooManyLoginAttempts(w, lockedFor)
 			return
 		}
-		sessionId := claims.deleteSessionId()
-		accessToken, err := middleware.NewJWT(time.Minute*5, claims)
+		delay, err := s.LoginDelay(r.Context(), userLogin.Email)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
 			return
 		}
-		claimsJson, err := json.Marshal(claims)
+		password, err := s.GetPasswordFromEmail(r.Context(), &userLogin)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			failLogin(s, w, r, &userLogin, ip)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(userLogin.Password)); err != nil {
+			failLogin(s, w, r, &userLogin, ip)
+			return
+		}
+		if err := s.ClearLoginFailures(r.Context(), userLogin.Email); err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		if err = s.CreateSession(userId, sessionId, string(claimsJson)); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		claims, err := s.GetClaimsFromEmail(r.Context(), &userLogin)
+		if err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		refreshCookie := http.Cookie{Name: "refreshToken", Value: refreshToken, Path: "/", Expires: time.Now().Add(time.Hour * 24 * 356), Secure: true, HttpOnly: true}
-		http.SetCookie(w, &refreshCookie)
+		finishLogin(s, w, r, claims, "")
+		return
+	}
+}
 
-		accessCookie := http.Cookie{Name: "accessToken", Value: accessToken, Path: "/", Expires: time.Now().Add(time.Minute * 5), Secure: true, HttpOnly: true}
-		http.SetCookie(w, &accessCookie)
+//Users with two-factor authentication get a challenge to answer instead of a session.
+//With a redirect URL the response of a successful login is a redirect to it instead of the claims.
+func finishLogin(s Service, w http.ResponseWriter, r *http.Request, claims *UserClaims, redirectURL string) {
+	hasTOTP, err := s.HasTOTP(r.Context(), claims.UserId)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if hasTOTP {
+		challengeToken, err := s.CreateMFAChallenge(r.Context(), claims.UserId)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		challenge := MFAChallenge{MFARequired: true, ChallengeToken: challengeToken, ExpiresIn: int(mfaChallengeTTL.Seconds())}
+		responses.JSONResponse(w, "Two-factor authentication required.", []MFAChallenge{challenge}, http.StatusOK)
+		return
+	}
+	claims.addSessionId()
+	if err := startSession(s, w, r, claims); err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if redirectURL != "" {
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+	responses.JSONResponse(w, "Successful Login.", []UserClaims{*claims}, 200)
+}
 
-		responses.JSONResponse(w, "Successful registration.", []User{user}, 200)
+func oidcLoginRedirect(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authURL, state, err := s.BeginOIDCLogin(r.Context(), chi.URLParam(r, "provider"))
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		//binds the login to this browser, so nobody can make a victim finish a login they started
+		stateCookie := http.Cookie{Name: "oidcState", Value: state, Path: "/api/users/oidc", MaxAge: int(oidcStateTTL.Seconds()), Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+		http.SetCookie(w, &stateCookie)
+		http.Redirect(w, r, authURL, http.StatusFound)
 		return
 	}
 }
 
-func login(s Service) func(w http.ResponseWriter, r *http.Request) {
+func oidcCallback(s Service) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			responses.JSONError(w, "Method type not allowed.", http.StatusMethodNotAllowed)
+		query := r.URL.Query()
+		stateCookie, err := r.Cookie("oidcState")
+		if err != nil || stateCookie.Value == "" || stateCookie.Value != query.Get("state") {
+			responses.JSONError(w, ErrInvalidOIDCState.Error(), http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		userLogin := UserLogin{}
-		_ = json.NewDecoder(r.Body).Decode(&userLogin)
-		password, err := s.GetPasswordFromEmail(&userLogin)
+		clearedCookie := http.Cookie{Name: "oidcState", Value: "", Path: "/api/users/oidc", Expires: time.Unix(0, 0), MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+		http.SetCookie(w, &clearedCookie)
+		if providerError := query.Get("error"); providerError != "" {
+			responses.JSONError(w, fmt.Sprintf("Login was not completed: %s", providerError), http.StatusUnauthorized)
+			return
+		}
+		claims, err := s.FinishOIDCLogin(r.Context(), chi.URLParam(r, "provider"), query.Get("state"), query.Get("code"))
 		if err != nil {
-			responses.JSONError(w, "Wrong email or password.", http.StatusBadRequest)
+			var domainError *apperrors.Error
+			if errors.As(err, &domainError) {
+				responses.Error(w, r, err)
+				return
+			}
+			//anything else went wrong talking to the provider
+			fmt.Println(fmt.Errorf("oidc: %w", err))
+			responses.JSONErrorCode(w, "The login provider could not be reached.", "oidc_provider_error", http.StatusBadGateway)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(password), []byte(userLogin.Password)); err != nil {
-			responses.JSONError(w, "Wrong email or password.", http.StatusBadRequest)
+		finishLogin(s, w, r, claims, utils.GetEnv("OIDC_LOGIN_REDIRECT_URL", ""))
+		return
+	}
+}
+
+func loginMFA(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mfaLogin := MFALogin{}
+		if err := json.NewDecoder(r.Body).Decode(&mfaLogin); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := mfaLogin.checkFields(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		userId, err := s.GetMFAChallengeUser(r.Context(), mfaLogin.ChallengeToken)
+		if err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		claims, err := s.GetClaimsFromEmail(&userLogin)
+		claims, err := s.GetClaimsFromId(r.Context(), userId)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
+		ip := utils.ClientIP(r)
+		lockedFor, err := s.LoginLockedFor(r.Context(), claims.Email, ip)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if lockedFor > 0 {
+			tooManyLoginAttempts(w, lockedFor)
+			return
+		}
+		if _, err := s.VerifyMFAChallenge(r.Context(), &mfaLogin); err != nil {
+			if errors.Is(err, ErrInvalidMFACode) {
+				failMFALogin(s, w, r, claims.Email, ip)
+				return
+			}
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.ClearMFAFailures(r.Context(), claims.Email); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		claims.MFA = true
 		claims.addSessionId()
-		refreshToken, err := middleware.NewJWT(time.Hour*24*356, map[string]interface{}{"sessionId": claims.SessionUUID, "userId": claims.UserId})
+		if err := startSession(s, w, r, claims); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Successful Login.", []UserClaims{*claims}, http.StatusOK)
+		return
+	}
+}
+
+func beginTOTPEnrollment(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := middleware.PrincipalFromContext(r.Context())
+		enrollment, err := s.BeginTOTPEnrollment(r.Context(), principal.UserId, principal.Email)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Add the secret to your authenticator app and confirm with a code.", []TOTPEnrollment{*enrollment}, http.StatusOK)
+		return
+	}
+}
+
+func confirmTOTPEnrollment(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := TOTPCode{}
+		if err := json.NewDecoder(r.Body).Decode(&code); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recoveryCodes, err := s.ConfirmTOTPEnrollment(r.Context(), userIdFromRequest(r), code.Code)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Two-factor authentication enabled. Store the recovery codes, they won't be shown again.", recoveryCodes, http.StatusOK)
+		return
+	}
+}
+
+func disableTOTP(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := TOTPCode{}
+		if err := json.NewDecoder(r.Body).Decode(&code); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.DisableTOTP(r.Context(), userIdFromRequest(r), code.Code); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Two-factor authentication disabled.", nil, http.StatusOK)
+		return
+	}
+}
+
+//The response is the same whether the email has an account or not.
+func failLogin(s Service, w http.ResponseWriter, r *http.Request, userLogin *UserLogin, ip string) {
+	lockedFor, err := s.RecordLoginFailure(r.Context(), userLogin.Email, ip)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if lockedFor > 0 {
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+	responses.JSONError(w, "Wrong email or password.", http.StatusBadRequest)
+}
+
+func failMFALogin(s Service, w http.ResponseWriter, r *http.Request, email string, ip string) {
+	lockedFor, err := s.RecordMFAFailure(r.Context(), email, ip)
+	if err != nil {
+		responses.Error(w, r, err)
+		return
+	}
+	if lockedFor > 0 {
+		tooManyLoginAttempts(w, lockedFor)
+		return
+	}
+	//a wrong code at login is a failed authentication, not a bad request
+	responses.JSONErrorCode(w, ErrInvalidMFACode.Error(), "invalid_mfa_code", http.StatusUnauthorized)
+}
+
+func tooManyLoginAttempts(w http.ResponseWriter, lockedFor time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	responses.JSONError(w, "Too many failed login attempts. Try again later.", http.StatusTooManyRequests)
+}
+
+func unlockWithToken(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unlock := LoginUnlock{Token: r.URL.Query().Get("token")}
+		if unlock.Token == "" {
+			_ = json.NewDecoder(r.Body).Decode(&unlock)
+		}
+		if strings.TrimSpace(unlock.Token) == "" {
+			responses.JSONError(w, "Token field can't be empty.", http.StatusBadRequest)
+			return
+		}
+		unlocked, err := s.UnlockLoginWithToken(r.Context(), unlock.Token)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if !unlocked {
+			responses.JSONError(w, "The unlock link is invalid or has expired.", http.StatusBadRequest)
+			return
+		}
+		responses.JSONResponse(w, "Successfully unlocked the account.", nil, http.StatusOK)
+		return
+	}
+}
+
+func unlockLogin(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unlock := LoginUnlock{}
+		if err := json.NewDecoder(r.Body).Decode(&unlock); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := unlock.checkFields(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if err := s.UnlockLogin(r.Context(), &unlock); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Successfully lifted the lockout.", nil, http.StatusOK)
+		return
+	}
+}
+
+func logout(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := middleware.PrincipalFromContext(r.Context()); ok {
+			if err := s.RevokeAccessToken(r.Context(), principal.TokenId, principal.ExpiresAt); err != nil {
+				responses.Error(w, r, err)
+				return
+			}
+		}
+		userId, sessionId := sessionFromRefreshToken(r)
+		if sessionId != "" {
+			if _, err := s.DeleteSession(r.Context(), userId, sessionId); err != nil {
+				responses.Error(w, r, err)
+				return
+			}
+		}
+		middleware.ClearSessionCookies(w)
+		responses.JSONResponse(w, "Successful logout.", nil, http.StatusOK)
+		return
+	}
+}
+
+func getSessions(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := userIdFromRequest(r)
+		sessions, err := s.GetSessions(r.Context(), userId)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
 			return
 		}
-		sessionUUID := claims.deleteSessionId()
-		accessToken, err := middleware.NewJWT(time.Minute*5, *claims)
+		refreshUserId, currentSessionId := sessionFromRefreshToken(r)
+		for i := 0; i < len(sessions); i++ {
+			sessions[i].Current = refreshUserId == userId && sessions[i].SessionId == currentSessionId
+			sessions[i].RefreshTokenId = ""
+		}
+		responses.JSONResponse(w, "Success.", sessions, http.StatusOK)
+		return
+	}
+}
+
+func deleteSession(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := userIdFromRequest(r)
+		sessionId := chi.URLParam(r, "id")
+		deleted, err := s.DeleteSession(r.Context(), userId, sessionId)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
+			return
+		}
+		if deleted == 0 {
+			responses.JSONError(w, "Session not found", http.StatusNotFound)
 			return
 		}
-		claimsJson, err := json.Marshal(claims)
+		refreshUserId, currentSessionId := sessionFromRefreshToken(r)
+		if refreshUserId == userId && sessionId == currentSessionId {
+			middleware.ClearSessionCookies(w)
+		}
+		responses.JSONResponse(w, "Successfully revoked session.", nil, http.StatusOK)
+		return
+	}
+}
+
+func deleteOtherSessions(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := userIdFromRequest(r)
+		refreshUserId, currentSessionId := sessionFromRefreshToken(r)
+		if currentSessionId == "" || refreshUserId != userId {
+			responses.JSONError(w, "The current session could not be determined.", http.StatusBadRequest)
+			return
+		}
+		deleted, err := s.DeleteOtherSessions(r.Context(), userId, currentSessionId)
 		if err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, fmt.Sprintf("Successfully revoked %d sessions.", deleted), nil, http.StatusOK)
+		return
+	}
+}
+
+func grantRole(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userRole := UserRole{}
+		if err := json.NewDecoder(r.Body).Decode(&userRole); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := userRole.checkFields(); err != nil {
+			responses.Error(w, r, err)
 			return
 		}
-		if err = s.CreateSession(claims.UserId, sessionUUID, string(claimsJson)); err != nil {
-			responses.JSONError(w, err.Error(), http.StatusInternalServerError)
+		roles, err := s.GrantRole(r.Context(), &userRole)
+		if err != nil {
+			responses.Error(w, r, err)
 			return
 		}
+		responses.JSONResponse(w, fmt.Sprintf("Successfully granted role %s.", userRole.Role), roles, http.StatusOK)
+		return
+	}
+}
 
-		refreshCookie := http.Cookie{Name: "refreshToken", Value: refreshToken, Path: "/", Expires: time.Now().Add(time.Hour * 24 * 356), Secure: true, HttpOnly: true}
-		http.SetCookie(w, &refreshCookie)
+func revokeRole(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userRole := UserRole{}
+		if err := json.NewDecoder(r.Body).Decode(&userRole); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := userRole.checkFields(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		roles, err := s.RevokeRole(r.Context(), &userRole)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, fmt.Sprintf("Successfully revoked role %s.", userRole.Role), roles, http.StatusOK)
+		return
+	}
+}
 
-		accessCookie := http.Cookie{Name: "accessToken", Value: accessToken, Path: "/", Expires: time.Now().Add(time.Minute * 5), Secure: true, HttpOnly: true}
-		http.SetCookie(w, &accessCookie)
+//The claims must already hold the id of the new session.
+func startSession(s Service, w http.ResponseWriter, r *http.Request, claims *UserClaims) error {
+	refreshToken, refreshTokenId, err := middleware.NewRefreshToken(claims.UserId, claims.SessionUUID)
+	if err != nil {
+		return err
+	}
+	sessionId := claims.deleteSessionId()
+	accessToken, err := middleware.NewJWT(middleware.AccessTokenTTL, *claims)
+	if err != nil {
+		return err
+	}
+	session := newSession(claims, r)
+	session.RefreshTokenId = refreshTokenId
+	if err = s.CreateSession(r.Context(), claims.UserId, sessionId, &session); err != nil {
+		return err
+	}
+	refreshCookie := http.Cookie{Name: "refreshToken", Value: refreshToken, Path: "/", Expires: time.Now().Add(middleware.RefreshTokenTTL), Secure: true, HttpOnly: true, SameSite: middleware.CookieSameSite()}
+	http.SetCookie(w, &refreshCookie)
+
+	accessCookie := http.Cookie{Name: "accessToken", Value: accessToken, Path: "/", Expires: time.Now().Add(middleware.AccessTokenTTL), Secure: true, HttpOnly: true, SameSite: middleware.CookieSameSite()}
+	http.SetCookie(w, &accessCookie)
+	if _, err := middleware.SetCSRFCookie(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func sessionFromRefreshToken(r *http.Request) (string, string) {
+	refreshCookie, err := r.Cookie("refreshToken")
+	if err != nil {
+		return "", ""
+	}
+	payload, err := middleware.Validate(refreshCookie.Value)
+	if err != nil {
+		return "", ""
+	}
+	data, ok := payload.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	userId, _ := data["userId"].(string)
+	sessionId, _ := data["sessionId"].(string)
+	return userId, sessionId
+}
+
+func createServiceAccount(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := ServiceAccount{}
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := account.checkFields(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		userId, err := s.CreateServiceAccount(r.Context(), &account)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		account.Id = userId
+		responses.JSONResponse(w, "Successfully created service account.", []ServiceAccount{account}, http.StatusCreated)
+		return
+	}
+}
+
+func apiKeyOwner(s Service, r *http.Request, requested string) (string, error) {
+	principal, _ := middleware.PrincipalFromContext(r.Context())
+	if requested == "" || requested == principal.UserId {
+		return principal.UserId, nil
+	}
+	if !principal.HasPermission(middleware.UsersManage) {
+		return "", apperrors.Forbidden("forbidden", fmt.Sprintf("Managing the API keys of service accounts requires the %s permission", middleware.UsersManage))
+	}
+	serviceAccount, err := s.IsServiceAccount(r.Context(), requested)
+	if err != nil {
+		return "", err
+	}
+	if !serviceAccount {
+		return "", apperrors.NotFound("service_account_not_found", "Service account not found")
+	}
+	return requested, nil
+}
+
+func createAPIKey(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := middleware.PrincipalFromContext(r.Context())
+		if principal.APIKeyId != "" {
+			responses.JSONError(w, "API keys can't be used to create API keys.", http.StatusForbidden)
+			return
+		}
+		apiKey := APIKey{}
+		if err := json.NewDecoder(r.Body).Decode(&apiKey); err != nil {
+			responses.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := apiKey.checkFields(); err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		for _, permission := range apiKey.Permissions {
+			if !principal.HasPermission(permission) {
+				responses.JSONError(w, fmt.Sprintf("You don't have the %s permission.", permission), http.StatusForbidden)
+				return
+			}
+		}
+		ownerId, err := apiKeyOwner(s, r, apiKey.UserId)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		apiKey.UserId = ownerId
+		created, err := s.CreateAPIKey(r.Context(), &apiKey)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Successfully created API key. Store the key now, it won't be shown again.", []APIKey{*created}, http.StatusCreated)
+		return
+	}
+}
 
-		responses.JSONResponse(w, "Successful Login.", []UserClaims{*claims}, 200)
+func getAPIKeys(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ownerId, err := apiKeyOwner(s, r, r.URL.Query().Get("userId"))
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		keys, err := s.GetAPIKeys(r.Context(), ownerId)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		responses.JSONResponse(w, "Successfully retrieved API keys.", keys, http.StatusOK)
 		return
 	}
 }
+
+func revokeAPIKey(s Service) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ownerId := userIdFromRequest(r)
+		if middleware.HasPermission(r, middleware.UsersManage) {
+			ownerId = ""
+		}
+		revoked, err := s.RevokeAPIKey(r.Context(), chi.URLParam(r, "id"), ownerId)
+		if err != nil {
+			responses.Error(w, r, err)
+			return
+		}
+		if revoked == 0 {
+			responses.JSONError(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		responses.JSONResponse(w, "Successfully revoked API key.", nil, http.StatusOK)
+		return
+	}
+}
+
+func userIdFromRequest(r *http.Request) string {
+	principal, ok := middleware.PrincipalFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return principal.UserId
+}
@@ -0,0 +1,195 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/google/uuid"
+)
+
+//Failed logins are counted in sliding windows per email and per client IP.
+//Every failure of an email delays the next attempt for it a bit more, and reaching the limit locks the email or IP out for a while.
+type lockoutPolicy struct {
+	maxEmailFailures int
+	maxIPFailures    int
+	window           time.Duration
+	lockout          time.Duration
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	unlockURL        string
+}
+
+func newLockoutPolicy() lockoutPolicy {
+	return lockoutPolicy{
+		maxEmailFailures: utils.GetEnvInt("LOGIN_MAX_FAILURES_PER_EMAIL", 5),
+		maxIPFailures:    utils.GetEnvInt("LOGIN_MAX_FAILURES_PER_IP", 20),
+		window:           utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		lockout:          utils.GetEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		baseDelay:        utils.GetEnvDuration("LOGIN_BASE_DELAY", 250*time.Millisecond),
+		maxDelay:         utils.GetEnvDuration("LOGIN_MAX_DELAY", 4*time.Second),
+		unlockURL:        utils.GetEnv("LOGIN_UNLOCK_URL", "http://localhost:3000/unlock?token="),
+	}
+}
+
+func (p lockoutPolicy) delay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	delay := p.baseDelay
+	for i := 1; i < failures && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		return p.maxDelay
+	}
+	return delay
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginFailuresKey(kind string, value string) string {
+	return "login_failures:" + kind + ":" + value
+}
+
+func loginLockoutKey(kind string, value string) string {
+	return "login_lockout:" + kind + ":" + value
+}
+
+func loginUnlockKey(token string) string {
+	return "login_unlock:" + token
+}
+
+func (s *service) LoginLockedFor(ctx context.Context, email string, ip string) (time.Duration, error) {
+	var lockedFor time.Duration
+	for _, key := range []string{loginLockoutKey("email", normalizeEmail(email)), loginLockoutKey("ip", ip)} {
+		ttl, err := s.redis.GetTTL(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if ttl > lockedFor {
+			lockedFor = ttl
+		}
+	}
+	return lockedFor, nil
+}
+
+func (s *service) LoginDelay(ctx context.Context, email string) (time.Duration, error) {
+	failures, err := s.redis.CountSlidingWindow(ctx, loginFailuresKey("email", normalizeEmail(email)), time.Now(), s.lockout.window)
+	if err != nil {
+		return 0, err
+	}
+	return s.lockout.delay(int(failures)), nil
+}
+
+//A locked out email is sent a link that lifts the lockout, in case the account owner is the one locked out.
+func (s *service) RecordLoginFailure(ctx context.Context, email string, ip string) (time.Duration, error) {
+	return s.recordFailure(ctx, "email", email, ip)
+}
+
+//Wrong two-factor codes are counted apart from wrong passwords, which a correct password clears, so knowing the password doesn't reset them.
+func (s *service) RecordMFAFailure(ctx context.Context, email string, ip string) (time.Duration, error) {
+	return s.recordFailure(ctx, "mfa", email, ip)
+}
+
+func (s *service) recordFailure(ctx context.Context, kind string, email string, ip string) (time.Duration, error) {
+	email = normalizeEmail(email)
+	now := time.Now()
+	var lockedFor time.Duration
+	emailFailures, err := s.redis.AddToSlidingWindow(ctx, loginFailuresKey(kind, email), now, s.lockout.window)
+	if err != nil {
+		return 0, err
+	}
+	if int(emailFailures) >= s.lockout.maxEmailFailures {
+		locked, err := s.redis.SetKeyNX(ctx, loginLockoutKey("email", email), now.Unix(), s.lockout.lockout)
+		if err != nil {
+			return 0, err
+		}
+		if locked {
+			go s.sendUnlockMail(email)
+		}
+		lockedFor = s.lockout.lockout
+	}
+	ipFailures, err := s.redis.AddToSlidingWindow(ctx, loginFailuresKey("ip", ip), now, s.lockout.window)
+	if err != nil {
+		return 0, err
+	}
+	if int(ipFailures) >= s.lockout.maxIPFailures {
+		if err := s.redis.SetKey(ctx, loginLockoutKey("ip", ip), now.Unix(), s.lockout.lockout); err != nil {
+			return 0, err
+		}
+		lockedFor = s.lockout.lockout
+	}
+	return lockedFor, nil
+}
+
+const unlockMailTimeout = 30 * time.Second
+
+//The mail is sent in the background, so the lookup of the account and the sending don't show in the response time of the login whether the email is registered or not.
+func (s *service) sendUnlockMail(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockMailTimeout)
+	defer cancel()
+	if err := s.mailUnlockLink(ctx, email); err != nil {
+		log.Printf("unlock mail: %v", err)
+	}
+}
+
+//The unlock link is only mailed if an account exists for the email.
+func (s *service) mailUnlockLink(ctx context.Context, email string) error {
+	if _, err := s.GetClaimsFromEmail(ctx, &UserLogin{Email: email}); err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	token := uuid.New().String()
+	if err := s.redis.SetKey(ctx, loginUnlockKey(token), email, s.lockout.lockout); err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Your account was locked after too many failed login attempts.\nIf this was you, you can unlock it here: %s%s\nOtherwise the lock ends on its own in %s.", s.lockout.unlockURL, token, s.lockout.lockout)
+	return s.mailer.Send(email, "Your account has been locked", body)
+}
+
+func (s *service) ClearLoginFailures(ctx context.Context, email string) error {
+	_, err := s.redis.DeleteKeys(ctx, loginFailuresKey("email", normalizeEmail(email)))
+	return err
+}
+
+func (s *service) ClearMFAFailures(ctx context.Context, email string) error {
+	_, err := s.redis.DeleteKeys(ctx, loginFailuresKey("mfa", normalizeEmail(email)))
+	return err
+}
+
+func (s *service) UnlockLoginWithToken(ctx context.Context, token string) (bool, error) {
+	email, err := s.redis.GetKey(ctx, loginUnlockKey(token))
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err = s.redis.DeleteKeys(ctx, loginUnlockKey(token), loginLockoutKey("email", email), loginFailuresKey("email", email), loginFailuresKey("mfa", email))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *service) UnlockLogin(ctx context.Context, unlock *LoginUnlock) error {
+	var keys []string
+	if email := normalizeEmail(unlock.Email); email != "" {
+		keys = append(keys, loginLockoutKey("email", email), loginFailuresKey("email", email), loginFailuresKey("mfa", email))
+	}
+	if ip := strings.TrimSpace(unlock.IP); ip != "" {
+		keys = append(keys, loginLockoutKey("ip", ip), loginFailuresKey("ip", ip))
+	}
+	_, err := s.redis.DeleteKeys(ctx, keys...)
+	return err
+}
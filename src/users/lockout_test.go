@@ -0,0 +1,107 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+func (s *identityStore) GetUserClaimsByEmail(ctx context.Context, email string) (*UserClaims, error) {
+	userId, err := s.GetUserIdByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	return &UserClaims{UserId: userId, Email: email}, nil
+}
+
+func (s *identityStore) GetRoles(ctx context.Context, userId string) ([]string, error) {
+	return nil, nil
+}
+
+type lockoutDb struct {
+	InMemoryDb
+	mu      sync.Mutex
+	keys    map[string]string
+	windows map[string]int64
+}
+
+func (db *lockoutDb) GetKey(ctx context.Context, key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if value, ok := db.keys[key]; ok {
+		return value, nil
+	}
+	return "", apperrors.NotFound("not_found", "not found")
+}
+
+func (db *lockoutDb) SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.keys[key] = fmt.Sprint(value)
+	return nil
+}
+
+func (db *lockoutDb) SetKeyNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	db.mu.Lock()
+	_, ok := db.keys[key]
+	db.mu.Unlock()
+	if ok {
+		return false, nil
+	}
+	return true, db.SetKey(ctx, key, value, exp)
+}
+
+func (db *lockoutDb) AddToSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.windows[key]++
+	return db.windows[key], nil
+}
+
+type mailbox chan string
+
+func (m mailbox) Send(to string, subject string, body string) error {
+	m <- body
+	return nil
+}
+
+func TestUnlockMailIsSentOncePerLock(t *testing.T) {
+	ctx := context.Background()
+	store := newIdentityStore()
+	store.add("user@example.com", false)
+	db := &lockoutDb{keys: map[string]string{}, windows: map[string]int64{}}
+	mails := make(mailbox, 10)
+	s := &service{rdbms: store, redis: db, mailer: mails, lockout: lockoutPolicy{maxEmailFailures: 3, maxIPFailures: 100, lockout: time.Minute, unlockURL: "https://shop.example.com/unlock?token="}}
+	for i := 1; i <= 5; i++ {
+		lockedFor, err := s.RecordLoginFailure(ctx, "User@example.com", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked := lockedFor > 0; locked != (i >= 3) {
+			t.Errorf("failure %d: locked for %s", i, lockedFor)
+		}
+	}
+	select {
+	case body := <-mails:
+		token := body[strings.Index(body, "token=")+len("token="):]
+		token = token[:strings.Index(token, "\n")]
+		if email, err := db.GetKey(ctx, loginUnlockKey(token)); err != nil || email != "user@example.com" {
+			t.Errorf("unlock token of %q: %v", email, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no unlock mail was sent")
+	}
+	select {
+	case <-mails:
+		t.Error("an unlock mail was sent for every failure after the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := s.mailUnlockLink(ctx, "unknown@example.com"); err != nil || len(mails) != 0 {
+		t.Errorf("unlock mail for an unknown email: %v", err)
+	}
+}
@@ -1,10 +1,16 @@
 package users
 
 import (
-	"errors"
-	"regexp"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/fnmzgdt/e_shop/src/middleware"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/fnmzgdt/e_shop/src/validation"
+
 	"github.com/google/uuid"
 )
 
@@ -20,34 +26,146 @@ type UserLogin struct {
 }
 
 type UserClaims struct {
-	Email       string `json:"email,omitempty"`
-	UserId      string `json:"userId,omitempty"`
-	SessionUUID string `json:"sessionId,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	UserId      string   `json:"userId,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	MFA         bool     `json:"mfa,omitempty"`
+	SessionUUID string   `json:"sessionId,omitempty"`
+}
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret,omitempty"`
+	ProvisioningURI string `json:"provisioningUri,omitempty"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code,omitempty"`
+}
+
+type MFAChallenge struct {
+	MFARequired    bool   `json:"mfaRequired,omitempty"`
+	ChallengeToken string `json:"challengeToken,omitempty"`
+	ExpiresIn      int    `json:"expiresIn,omitempty"`
+}
+
+type MFALogin struct {
+	ChallengeToken string `json:"challengeToken,omitempty"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recoveryCode,omitempty"`
+}
+
+type ExternalIdentity struct {
+	Provider      string `json:"provider,omitempty"`
+	Subject       string `json:"subject,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"emailVerified,omitempty"`
+}
+
+type oidcLogin struct {
+	Provider string `json:"provider,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Verifier string `json:"verifier,omitempty"`
+}
+
+type LoginUnlock struct {
+	Token string `json:"token,omitempty"`
+	Email string `json:"email,omitempty"`
+	IP    string `json:"ip,omitempty"`
+}
+
+type UserRole struct {
+	UserId string `json:"userId,omitempty"`
+	Role   string `json:"role,omitempty"`
+}
+
+//The Key of an APIKey is only filled in the response that creates it.
+type APIKey struct {
+	Id          string   `json:"id,omitempty"`
+	UserId      string   `json:"userId,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Prefix      string   `json:"prefix,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	AllowedIPs  []string `json:"allowedIps,omitempty"`
+	ExpiresAt   int64    `json:"expiresAt,omitempty"`
+	LastUsedAt  int64    `json:"lastUsedAt,omitempty"`
+	CreatedAt   int64    `json:"createdAt,omitempty"`
+	RevokedAt   int64    `json:"revokedAt,omitempty"`
 }
 
+type ServiceAccount struct {
+	Id    string `json:"id,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+//Passwords longer than 72 bytes would be cut off by bcrypt.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
 func NewUser() User {
 	now := time.Now().Unix()
 	return User{CreatedAt: now}
 }
 
 func (u User) checkFields() error {
-	if u.CreatedAt == 0 {
-		return errors.New("CreatedAt field can't be a null value.")
+	v := validation.New()
+	v.Int64("createdAt", u.CreatedAt).Required()
+	v.String("email", u.Email).Required().Email()
+	v.String("password", u.Password).Required().MinLength(minPasswordLength).MaxLength(maxPasswordLength)
+	return v.Err()
+}
+
+func (ur UserRole) checkFields() error {
+	v := validation.New()
+	v.String("userId", ur.UserId).Required()
+	v.String("role", ur.Role).Required().OneOf(middleware.Roles()...)
+	return v.Err()
+}
+
+func (k APIKey) checkFields() error {
+	v := validation.New()
+	v.String("name", k.Name).Required().MaxLength(100)
+	v.Check("permissions", len(k.Permissions) != 0, "required", "Permissions can't be empty.")
+	for i, permission := range k.Permissions {
+		v.String(fmt.Sprintf("permissions[%d]", i), permission).Required().OneOf(middleware.Permissions()...)
 	}
-	if !isEmailValid(u.Email) {
-		return errors.New("Please enter a valid email.")
+	for i, ip := range k.AllowedIPs {
+		_, _, err := net.ParseCIDR(ip)
+		v.Check(fmt.Sprintf("allowedIps[%d]", i), err == nil || net.ParseIP(ip) != nil, "invalid_ip", fmt.Sprintf("%s is not an IP address or CIDR range.", ip))
 	}
-	return nil
+	v.Int64("expiresAt", k.ExpiresAt).Future()
+	return v.Err()
+}
+
+func (sa ServiceAccount) checkFields() error {
+	v := validation.New()
+	v.String("email", sa.Email).Required().Email()
+	return v.Err()
+}
+
+func (lu LoginUnlock) checkFields() error {
+	v := validation.New()
+	v.Check("", strings.TrimSpace(lu.Email) != "" || strings.TrimSpace(lu.IP) != "", "email_or_ip_required", "Include the email or the IP to unlock.")
+	v.Check("ip", lu.IP == "" || net.ParseIP(lu.IP) != nil, "invalid_ip", fmt.Sprintf("%s is not an IP address.", lu.IP))
+	return v.Err()
+}
+
+func (l MFALogin) checkFields() error {
+	v := validation.New()
+	v.String("challengeToken", l.ChallengeToken).Required()
+	v.Check("code", strings.TrimSpace(l.Code) != "" || strings.TrimSpace(l.RecoveryCode) != "", "code_required", "Include a code from your authenticator app or a recovery code.")
+	return v.Err()
 }
 
 func isEmailValid(e string) bool {
-	emailRegex := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
-	return emailRegex.MatchString(e)
+	return validation.IsEmail(e)
 }
 
 func (u *User) createClaims(userId string) UserClaims {
 	sessionId := uuid.New().String()
-	return UserClaims{Email: u.Email, UserId: userId, SessionUUID: sessionId}
+	return UserClaims{Email: u.Email, UserId: userId, Roles: []string{}, SessionUUID: sessionId}
 }
 
 func (u *UserClaims) addSessionId() {
@@ -60,3 +178,23 @@ func (u *UserClaims) deleteSessionId() string {
 	u.SessionUUID = ""
 	return sessionId
 }
+
+type Session struct {
+	SessionId      string   `json:"sessionId,omitempty"`
+	Email          string   `json:"email,omitempty"`
+	UserId         string   `json:"userId,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	MFA            bool     `json:"mfa,omitempty"`
+	Device         string   `json:"device,omitempty"`
+	IP             string   `json:"ip,omitempty"`
+	CreatedAt      int64    `json:"createdAt,omitempty"`
+	LastUsedAt     int64    `json:"lastUsedAt,omitempty"`
+	RefreshTokenId string   `json:"refreshTokenId,omitempty"`
+	Current        bool     `json:"current,omitempty"`
+}
+
+//The session id is not part of the stored value; it is only a part of the session key.
+func newSession(claims *UserClaims, r *http.Request) Session {
+	now := time.Now().Unix()
+	return Session{Email: claims.Email, UserId: claims.UserId, Roles: claims.Roles, MFA: claims.MFA, Device: r.UserAgent(), IP: utils.ClientIP(r), CreatedAt: now, LastUsedAt: now}
+}
@@ -0,0 +1,453 @@
+package users
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+//Providers are configured with OIDC_PROVIDERS, a comma separated list of names, and for every name OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and OIDC_<NAME>_REDIRECT_URL.
+//Everything else is read from the provider's discovery document, so a local mock provider works like a real one.
+
+const (
+	oidcStateTTL         = 10 * time.Minute
+	oidcKeysRefetchAfter = time.Minute
+)
+
+var (
+	ErrUnknownOIDCProvider = apperrors.NotFound("unknown_oidc_provider", "unknown login provider")
+	ErrInvalidOIDCState    = apperrors.Validation("invalid_oidc_state", "invalid or expired login state")
+	ErrOIDCEmailUnverified = apperrors.Forbidden("oidc_email_unverified", "the login provider did not confirm the email address")
+	ErrOIDCServiceAccount  = apperrors.Conflict("oidc_service_account", "the email address belongs to a service account, which can't log in")
+)
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JwksURI               string   `json:"jwks_uri"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcProvider struct {
+	name         string
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+func newOIDCProviders() map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider)
+	for _, name := range strings.Split(utils.GetEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &oidcProvider{
+			name:         name,
+			issuer:       strings.TrimSuffix(utils.GetEnv(prefix+"ISSUER", ""), "/"),
+			clientId:     utils.GetEnv(prefix+"CLIENT_ID", ""),
+			clientSecret: utils.GetEnv(prefix+"CLIENT_SECRET", ""),
+			redirectURL:  utils.GetEnv(prefix+"REDIRECT_URL", ""),
+			scopes:       strings.Fields(utils.GetEnv(prefix+"SCOPES", "openid email profile")),
+			client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		if provider.issuer == "" || provider.clientId == "" || provider.redirectURL == "" {
+			fmt.Println(fmt.Errorf("oidc: provider %s needs an issuer, a client id and a redirect url", name))
+			continue
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", endpoint, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(target)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	discovery := &oidcDiscovery{}
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc: discovery document of %s is for issuer %s", p.issuer, discovery.Issuer)
+	}
+	p.discovery = discovery
+	return discovery, nil
+}
+
+func (p *oidcProvider) authorizationURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", strings.Join(p.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func (p *oidcProvider) exchange(ctx context.Context, code string, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.clientId)
+	form.Set("code_verifier", verifier)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	tokens := struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK || tokens.IdToken == "" {
+		return "", fmt.Errorf("oidc: token request failed: %s %s %s", res.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	return tokens.IdToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, idToken string, nonce string) (*ExternalIdentity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	algs := discovery.SigningAlgs
+	if len(algs) == 0 {
+		algs = []string{"RS256"}
+	}
+	claims := jwt.MapClaims{}
+	parser := jwt.Parser{ValidMethods: algs}
+	_, err = parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("oidc: id token: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return nil, fmt.Errorf("oidc: id token issued by %s", iss)
+	}
+	if !audienceContains(claims["aud"], p.clientId) {
+		return nil, errors.New("oidc: id token is not meant for this client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("oidc: id token has no expiry")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("oidc: id token nonce does not match")
+	}
+	identity := &ExternalIdentity{Provider: p.name}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("oidc: id token has no subject")
+	}
+	return identity, nil
+}
+
+func audienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//The JWKS is fetched again when the kid is unknown, since the provider may have rotated its keys, but at most once a minute.
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (interface{}, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefetchAfter {
+		return nil, fmt.Errorf("oidc: unknown key %q", kid)
+	}
+	jwks := struct {
+		Keys []oidcJWK `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, discovery.JwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]interface{})
+	p.keysFetchedAt = time.Now()
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key %q", kid)
+}
+
+func (k oidcJWK) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func randomURLString(size int) (string, error) {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func oidcStateKey(state string) string {
+	return "oidc_states:" + state
+}
+
+func (s *service) BeginOIDCLogin(ctx context.Context, providerName string) (string, string, error) {
+	provider, ok := s.oidc[providerName]
+	if !ok {
+		return "", "", ErrUnknownOIDCProvider
+	}
+	state, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	login := oidcLogin{Provider: providerName}
+	if login.Nonce, err = randomURLString(32); err != nil {
+		return "", "", err
+	}
+	if login.Verifier, err = randomURLString(48); err != nil {
+		return "", "", err
+	}
+	authURL, err := provider.authorizationURL(ctx, state, login.Nonce, login.Verifier)
+	if err != nil {
+		return "", "", err
+	}
+	loginJson, err := json.Marshal(login)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.redis.SetKey(ctx, oidcStateKey(state), string(loginJson), oidcStateTTL); err != nil {
+		return "", "", err
+	}
+	return authURL, state, nil
+}
+
+func (s *service) FinishOIDCLogin(ctx context.Context, providerName string, state string, code string) (*UserClaims, error) {
+	provider, ok := s.oidc[providerName]
+	if !ok {
+		return nil, ErrUnknownOIDCProvider
+	}
+	loginJson, err := s.redis.GetKey(ctx, oidcStateKey(state))
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return nil, ErrInvalidOIDCState
+		}
+		return nil, err
+	}
+	deleted, err := s.redis.DeleteKeys(ctx, oidcStateKey(state))
+	if err != nil {
+		return nil, err
+	}
+	login := oidcLogin{}
+	if err := json.Unmarshal([]byte(loginJson), &login); err != nil {
+		return nil, err
+	}
+	if deleted == 0 || login.Provider != providerName {
+		return nil, ErrInvalidOIDCState
+	}
+	idToken, err := provider.exchange(ctx, code, login.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := provider.verifyIDToken(ctx, idToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := s.userIdFromIdentity(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetClaimsFromId(ctx, userId)
+}
+
+func (s *service) userIdFromIdentity(ctx context.Context, identity *ExternalIdentity) (string, error) {
+	userId, err := s.rdbms.GetIdentityUserId(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		if err := s.refuseServiceAccount(ctx, userId); err != nil {
+			return "", err
+		}
+		return userId, nil
+	}
+	if !errors.Is(err, apperrors.ErrNotFound) {
+		return "", err
+	}
+	if !identity.EmailVerified || !isEmailValid(normalizeEmail(identity.Email)) {
+		return "", ErrOIDCEmailUnverified
+	}
+	email := normalizeEmail(identity.Email)
+	userId, err = s.rdbms.GetUserIdByEmail(ctx, email)
+	switch {
+	case err == nil:
+		if err := s.refuseServiceAccount(ctx, userId); err != nil {
+			return "", err
+		}
+	case errors.Is(err, apperrors.ErrNotFound):
+		user := NewUser()
+		user.Email = email
+		if userId, err = s.InsertUser(ctx, &user); err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+	if err := s.rdbms.InsertIdentity(ctx, identity, userId, email); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+//Service accounts must not log in interactively, so no login provider account is linked to one.
+func (s *service) refuseServiceAccount(ctx context.Context, userId string) error {
+	serviceAccount, err := s.rdbms.IsServiceAccount(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if serviceAccount {
+		return ErrOIDCServiceAccount
+	}
+	return nil
+}
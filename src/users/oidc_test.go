@@ -0,0 +1,92 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+type identityStore struct {
+	Rdbms
+	emails          map[string]string
+	serviceAccounts map[string]bool
+	identities      map[string]string
+}
+
+func newIdentityStore() *identityStore {
+	return &identityStore{emails: map[string]string{}, serviceAccounts: map[string]bool{}, identities: map[string]string{}}
+}
+
+func (s *identityStore) add(email string, serviceAccount bool) string {
+	userId := strconv.Itoa(len(s.emails) + 1)
+	s.emails[email] = userId
+	s.serviceAccounts[userId] = serviceAccount
+	return userId
+}
+
+func (s *identityStore) InsertUser(ctx context.Context, email string, password string) (string, error) {
+	return s.add(email, false), nil
+}
+
+func (s *identityStore) GetUserIdByEmail(ctx context.Context, email string) (string, error) {
+	if userId, ok := s.emails[email]; ok {
+		return userId, nil
+	}
+	return "", apperrors.NotFound("not_found", "not found")
+}
+
+func (s *identityStore) IsServiceAccount(ctx context.Context, userId string) (bool, error) {
+	return s.serviceAccounts[userId], nil
+}
+
+func (s *identityStore) GetIdentityUserId(ctx context.Context, provider string, subject string) (string, error) {
+	if userId, ok := s.identities[provider+":"+subject]; ok {
+		return userId, nil
+	}
+	return "", apperrors.NotFound("not_found", "not found")
+}
+
+func (s *identityStore) InsertIdentity(ctx context.Context, identity *ExternalIdentity, userId string, email string) error {
+	s.identities[identity.Provider+":"+identity.Subject] = userId
+	return nil
+}
+
+func TestUserIdFromIdentity(t *testing.T) {
+	ctx := context.Background()
+	store := newIdentityStore()
+	s := &service{rdbms: store}
+	userId := store.add("user@example.com", false)
+	store.add("robot@example.com", true)
+
+	tests := []struct {
+		name     string
+		identity ExternalIdentity
+		userId   string
+		err      error
+	}{
+		{"links an existing user", ExternalIdentity{Provider: "google", Subject: "1", Email: "User@Example.com", EmailVerified: true}, userId, nil},
+		{"finds the linked user", ExternalIdentity{Provider: "google", Subject: "1"}, userId, nil},
+		{"creates a new user", ExternalIdentity{Provider: "google", Subject: "2", Email: "new@example.com", EmailVerified: true}, "3", nil},
+		{"refuses an unverified email", ExternalIdentity{Provider: "google", Subject: "3", Email: "other@example.com"}, "", ErrOIDCEmailUnverified},
+		{"refuses a service account", ExternalIdentity{Provider: "google", Subject: "4", Email: "robot@example.com", EmailVerified: true}, "", ErrOIDCServiceAccount},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := s.userIdFromIdentity(ctx, &test.identity)
+			if got != test.userId || !errors.Is(err, test.err) {
+				t.Errorf("got user %q and %v, want user %q and %v", got, err, test.userId, test.err)
+			}
+		})
+	}
+	if _, linked := store.identities["google:4"]; linked {
+		t.Error("the service account was linked")
+	}
+
+	store.identities["google:5"] = store.emails["robot@example.com"]
+	if _, err := s.userIdFromIdentity(ctx, &ExternalIdentity{Provider: "google", Subject: "5"}); !errors.Is(err, ErrOIDCServiceAccount) {
+		t.Errorf("identity linked to a service account: %v", err)
+	}
+}
@@ -1,12 +1,37 @@
 package users
 
 import (
+	"time"
+
+	M "github.com/fnmzgdt/e_shop/src/middleware"
 	"github.com/go-chi/chi"
 )
 
-func UsersRoutes(s Service) *chi.Mux {
+func UsersRoutes(s Service, m M.Controller) *chi.Mux {
+	timeout := M.NewTimeoutPolicy("users", 5*time.Second)
+	//logins hash the password and may be delayed after failed attempts
+	loginTimeout := M.NewTimeoutPolicy("users-login", 10*time.Second)
+	oidcTimeout := M.NewTimeoutPolicy("users-oidc", 15*time.Second)
 	router := chi.NewRouter()
-	router.Post("/user", registerUser(s))
-	router.Post("/login", login(s))
+	router.With(m.Timeout(loginTimeout)).Post("/user", registerUser(s))
+	router.With(m.Timeout(loginTimeout)).Post("/login", login(s))
+	router.With(m.Timeout(loginTimeout)).Post("/login/mfa", loginMFA(s))
+	router.With(m.Timeout(oidcTimeout)).Get("/oidc/{provider}/login", oidcLoginRedirect(s))
+	router.With(m.Timeout(oidcTimeout)).Get("/oidc/{provider}/callback", oidcCallback(s))
+	router.With(m.Timeout(timeout)).Post("/logout", logout(s))
+	router.With(m.Timeout(timeout)).Post("/unlock", unlockWithToken(s))
+	router.With(m.Timeout(timeout), m.RequirePermission(M.UsersManage)).Delete("/lockouts", unlockLogin(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Get("/sessions", getSessions(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Delete("/sessions", deleteOtherSessions(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Delete("/sessions/{id}", deleteSession(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Post("/2fa", beginTOTPEnrollment(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Post("/2fa/confirm", confirmTOTPEnrollment(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Delete("/2fa", disableTOTP(s))
+	router.With(m.Timeout(timeout), m.RequirePermission(M.RolesManage)).Post("/roles", grantRole(s))
+	router.With(m.Timeout(timeout), m.RequirePermission(M.RolesManage)).Delete("/roles", revokeRole(s))
+	router.With(m.Timeout(timeout), m.RequirePermission(M.UsersManage)).Post("/service-accounts", createServiceAccount(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Get("/apikeys", getAPIKeys(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Post("/apikeys", createAPIKey(s))
+	router.With(m.Timeout(timeout), m.Authorize()).Delete("/apikeys/{id}", revokeAPIKey(s))
 	return router
 }
@@ -1,87 +1,313 @@
 package users
 
 import (
-	"database/sql"
-	"fmt"
-	"strconv"
+	"context"
+	"encoding/json"
+	"errors"
 	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
 )
 
 type Service interface {
-	InsertUser(user *User) (string, error)
-	CreateSession(userId string, sessionId string, valueName interface{}) error
-	GetPasswordFromEmail(user *UserLogin) (string, error)
-	GetClaimsFromEmail(user *UserLogin) (*UserClaims, error)
-	GetSession() (string, error)
+	InsertUser(ctx context.Context, user *User) (string, error)
+	CreateSession(ctx context.Context, userId string, sessionId string, session *Session) error
+	GetPasswordFromEmail(ctx context.Context, user *UserLogin) (string, error)
+	GetClaimsFromEmail(ctx context.Context, user *UserLogin) (*UserClaims, error)
+	GetSession(ctx context.Context, userId string, sessionId string) (*Session, error)
+	GetSessions(ctx context.Context, userId string) ([]Session, error)
+	DeleteSession(ctx context.Context, userId string, sessionId string) (int, error)
+	DeleteOtherSessions(ctx context.Context, userId string, currentSessionId string) (int, error)
+	GrantRole(ctx context.Context, userRole *UserRole) ([]string, error)
+	RevokeRole(ctx context.Context, userRole *UserRole) ([]string, error)
+	RevokeAccessToken(ctx context.Context, tokenId string, expiresAt int64) error
+	LoginLockedFor(ctx context.Context, email string, ip string) (time.Duration, error)
+	LoginDelay(ctx context.Context, email string) (time.Duration, error)
+	RecordLoginFailure(ctx context.Context, email string, ip string) (time.Duration, error)
+	ClearLoginFailures(ctx context.Context, email string) error
+	RecordMFAFailure(ctx context.Context, email string, ip string) (time.Duration, error)
+	ClearMFAFailures(ctx context.Context, email string) error
+	UnlockLoginWithToken(ctx context.Context, token string) (bool, error)
+	UnlockLogin(ctx context.Context, unlock *LoginUnlock) error
+	GetClaimsFromId(ctx context.Context, userId string) (*UserClaims, error)
+	HasTOTP(ctx context.Context, userId string) (bool, error)
+	BeginTOTPEnrollment(ctx context.Context, userId string, email string) (*TOTPEnrollment, error)
+	ConfirmTOTPEnrollment(ctx context.Context, userId string, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, userId string, code string) error
+	CreateMFAChallenge(ctx context.Context, userId string) (string, error)
+	GetMFAChallengeUser(ctx context.Context, token string) (string, error)
+	VerifyMFAChallenge(ctx context.Context, login *MFALogin) (string, error)
+	BeginOIDCLogin(ctx context.Context, providerName string) (string, string, error)
+	FinishOIDCLogin(ctx context.Context, providerName string, state string, code string) (*UserClaims, error)
+	CreateServiceAccount(ctx context.Context, account *ServiceAccount) (string, error)
+	IsServiceAccount(ctx context.Context, userId string) (bool, error)
+	CreateAPIKey(ctx context.Context, apiKey *APIKey) (*APIKey, error)
+	GetAPIKeys(ctx context.Context, userId string) (*[]APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyId string, ownerId string) (int, error)
 }
 
 type Rdbms interface {
-	ExecuteQuery(query string, values ...interface{}) (sql.Result, error)
-	GetPassword(query string, values ...interface{}) (string, error)
-	GetUserDetails(query string, values ...interface{}) (*UserClaims, error)
+	InsertUser(ctx context.Context, email string, password string) (string, error)
+	InsertServiceAccount(ctx context.Context, email string) (string, error)
+	IsServiceAccount(ctx context.Context, userId string) (bool, error)
+	GetPassword(ctx context.Context, email string) (string, error)
+	GetUserClaimsByEmail(ctx context.Context, email string) (*UserClaims, error)
+	GetUserClaimsById(ctx context.Context, userId string) (*UserClaims, error)
+	GetUserIdByEmail(ctx context.Context, email string) (string, error)
+	GetRoles(ctx context.Context, userId string) ([]string, error)
+	InsertRole(ctx context.Context, userId string, role string) error
+	DeleteRole(ctx context.Context, userId string, role string) error
+	InsertAPIKey(ctx context.Context, apiKey *APIKey, prefix string, hash string) (string, error)
+	GetAPIKeys(ctx context.Context, userId string) (*[]APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyId string, ownerId string) (int64, error)
+	GetTOTPSecret(ctx context.Context, userId string) (string, error)
+	SetTOTPSecret(ctx context.Context, userId string, secret string) error
+	ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error)
+	GetIdentityUserId(ctx context.Context, provider string, subject string) (string, error)
+	InsertIdentity(ctx context.Context, identity *ExternalIdentity, userId string, email string) error
 }
 
 type InMemoryDb interface {
-	GetKey(key string) (string, error)
-	SetKey(key string, value interface{}, exp time.Duration) error
+	GetKey(ctx context.Context, key string) (string, error)
+	SetKey(ctx context.Context, key string, value interface{}, exp time.Duration) error
+	UpdateKey(ctx context.Context, key string, update func(value string) (string, error)) error
+	SetKeyNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error)
+	DeleteKeys(ctx context.Context, keys ...string) (int64, error)
+	AddToSet(ctx context.Context, key string, exp time.Duration, members ...interface{}) error
+	GetSetMembers(ctx context.Context, key string) ([]string, error)
+	RemoveFromSet(ctx context.Context, key string, members ...interface{}) error
+	GetTTL(ctx context.Context, key string) (time.Duration, error)
+	AddToSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error)
+	CountSlidingWindow(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error)
+}
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+type TokenRevoker interface {
+	RevokeAccessToken(ctx context.Context, tokenId string, expiresAt int64) error
+	RevokeUserTokens(ctx context.Context, userId string) error
+}
+
+const sessionTTL = 24 * 30 * time.Hour
+
+func sessionKey(userId string, sessionId string) string {
+	return "sessions:" + userId + ":" + sessionId
+}
+
+func sessionIndexKey(userId string) string {
+	return "user_sessions:" + userId
 }
 
 type service struct {
-	mysql Rdbms
-	redis InMemoryDb
+	rdbms   Rdbms
+	redis   InMemoryDb
+	tokens  TokenRevoker
+	mailer  Mailer
+	lockout lockoutPolicy
+	oidc    map[string]*oidcProvider
 }
 
-func NewUserssService(a Rdbms, b InMemoryDb) Service {
-	return &service{mysql: a, redis: b}
+func NewUserssService(a Rdbms, b InMemoryDb, c TokenRevoker, d Mailer) Service {
+	return &service{rdbms: a, redis: b, tokens: c, mailer: d, lockout: newLockoutPolicy(), oidc: newOIDCProviders()}
 }
 
-func (s *service) InsertUser(user *User) (string, error) {
-	query := "INSERT INTO users(email, password) VALUES (?, ?)"
-	result, err := s.mysql.ExecuteQuery(query, user.Email, user.Password)
+func (s *service) InsertUser(ctx context.Context, user *User) (string, error) {
+	userId, err := s.rdbms.InsertUser(ctx, user.Email, user.Password)
 	if err != nil {
-		return "", err
+		return "", emailTakenError(err)
 	}
-	lastInsertId, err := result.LastInsertId()
-	if err != nil {
-		return "", err
+	return userId, nil
+}
+
+func emailTakenError(err error) error {
+	if errors.Is(err, apperrors.ErrConflict) {
+		return apperrors.New(apperrors.ErrConflict, "email_taken", "An account with this email already exists.", err)
 	}
-	lastInsertIdStr := strconv.FormatInt(lastInsertId, 10)
-	return lastInsertIdStr, nil
+	return err
 }
 
-func (s *service) GetPasswordFromEmail(user *UserLogin) (string, error) {
-	query := "SELECT password FROM users WHERE email = ?;"
-	password, err := s.mysql.GetPassword(query, user.Email)
+func (s *service) GetPasswordFromEmail(ctx context.Context, user *UserLogin) (string, error) {
+	password, err := s.rdbms.GetPassword(ctx, user.Email)
 	if err != nil {
 		return "", nil
 	}
 	return password, nil
 }
 
-func (s *service) GetClaimsFromEmail(user *UserLogin) (*UserClaims, error) {
-	query := "SELECT id AS userId, email FROM users WHERE email = ?;"
-	claims, err := s.mysql.GetUserDetails(query, user.Email)
+func (s *service) GetClaimsFromEmail(ctx context.Context, user *UserLogin) (*UserClaims, error) {
+	claims, err := s.rdbms.GetUserClaimsByEmail(ctx, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := s.getRoles(ctx, claims.UserId)
+	if err != nil {
+		return nil, err
+	}
+	claims.Roles = roles
+	return claims, nil
+}
+
+func (s *service) GetClaimsFromId(ctx context.Context, userId string) (*UserClaims, error) {
+	claims, err := s.rdbms.GetUserClaimsById(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := s.getRoles(ctx, claims.UserId)
 	if err != nil {
 		return nil, err
 	}
+	claims.Roles = roles
 	return claims, nil
 }
 
-func (s *service) CreateSession(userId string, sessionId string, valueName interface{}) error {
-	key := "sessions:" + userId + ":" + sessionId
-	fmt.Println(key)
-	exp := time.Duration(24 * 30 * time.Hour) //TTL for the session
-	err := s.redis.SetKey(key, valueName, exp)
+func (s *service) getRoles(ctx context.Context, userId string) ([]string, error) {
+	return s.rdbms.GetRoles(ctx, userId)
+}
+
+func (s *service) GrantRole(ctx context.Context, userRole *UserRole) ([]string, error) {
+	if err := s.rdbms.InsertRole(ctx, userRole.UserId, userRole.Role); err != nil {
+		if errors.Is(err, apperrors.ErrValidation) {
+			return nil, apperrors.New(apperrors.ErrNotFound, "user_not_found", "User not found", err)
+		}
+		return nil, err
+	}
+	return s.updateSessionRoles(ctx, userRole.UserId)
+}
+
+func (s *service) RevokeRole(ctx context.Context, userRole *UserRole) ([]string, error) {
+	if err := s.rdbms.DeleteRole(ctx, userRole.UserId, userRole.Role); err != nil {
+		return nil, err
+	}
+	return s.updateSessionRoles(ctx, userRole.UserId)
+}
+
+//Revoking the access tokens carrying the old roles makes the change take effect with the next renewed access token.
+func (s *service) updateSessionRoles(ctx context.Context, userId string) ([]string, error) {
+	roles, err := s.getRoles(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	sessionIds, err := s.redis.GetSetMembers(ctx, sessionIndexKey(userId))
 	if err != nil {
+		return nil, err
+	}
+	for _, sessionId := range sessionIds {
+		err := s.redis.UpdateKey(ctx, sessionKey(userId, sessionId), func(value string) (string, error) {
+			session := Session{}
+			if err := json.Unmarshal([]byte(value), &session); err != nil {
+				return "", err
+			}
+			session.Roles = roles
+			sessionJson, err := json.Marshal(session)
+			return string(sessionJson), err
+		})
+		if err != nil && !errors.Is(err, apperrors.ErrNotFound) {
+			return nil, err
+		}
+	}
+	if err := s.tokens.RevokeUserTokens(ctx, userId); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (s *service) CreateSession(ctx context.Context, userId string, sessionId string, session *Session) error {
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := s.redis.SetKey(ctx, sessionKey(userId, sessionId), string(sessionJson), sessionTTL); err != nil {
 		return err
 	}
-	return nil
+	return s.redis.AddToSet(ctx, sessionIndexKey(userId), sessionTTL, sessionId)
 }
 
-func (s *service) GetSession() (string, error) {
-	value, err := s.redis.GetKey("key1")
+func (s *service) GetSession(ctx context.Context, userId string, sessionId string) (*Session, error) {
+	value, err := s.redis.GetKey(ctx, sessionKey(userId, sessionId))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal([]byte(value), session); err != nil {
+		return nil, err
+	}
+	session.SessionId = sessionId
+	return session, nil
+}
+
+//Ids of sessions that have already expired are removed from the index.
+func (s *service) GetSessions(ctx context.Context, userId string) ([]Session, error) {
+	sessionIds, err := s.redis.GetSetMembers(ctx, sessionIndexKey(userId))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, 0, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		session, err := s.GetSession(ctx, userId, sessionId)
+		if err != nil {
+			if errors.Is(err, apperrors.ErrNotFound) {
+				if err := s.redis.RemoveFromSet(ctx, sessionIndexKey(userId), sessionId); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+		sessions = append(sessions, *session)
 	}
-	return value, nil
+	return sessions, nil
+}
+
+//All access tokens of the user issued until now are revoked; the user's other sessions renew theirs.
+func (s *service) DeleteSession(ctx context.Context, userId string, sessionId string) (int, error) {
+	deleted, err := s.redis.DeleteKeys(ctx, sessionKey(userId, sessionId))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.redis.RemoveFromSet(ctx, sessionIndexKey(userId), sessionId); err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		if err := s.tokens.RevokeUserTokens(ctx, userId); err != nil {
+			return 0, err
+		}
+	}
+	return int(deleted), nil
+}
+
+func (s *service) DeleteOtherSessions(ctx context.Context, userId string, currentSessionId string) (int, error) {
+	sessionIds, err := s.redis.GetSetMembers(ctx, sessionIndexKey(userId))
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	var members []interface{}
+	for _, sessionId := range sessionIds {
+		if sessionId == currentSessionId {
+			continue
+		}
+		keys = append(keys, sessionKey(userId, sessionId))
+		members = append(members, sessionId)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	deleted, err := s.redis.DeleteKeys(ctx, keys...)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.redis.RemoveFromSet(ctx, sessionIndexKey(userId), members...); err != nil {
+		return 0, err
+	}
+	if err := s.tokens.RevokeUserTokens(ctx, userId); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+func (s *service) RevokeAccessToken(ctx context.Context, tokenId string, expiresAt int64) error {
+	return s.tokens.RevokeAccessToken(ctx, tokenId, expiresAt)
 }
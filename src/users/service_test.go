@@ -0,0 +1,160 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/middleware"
+	"github.com/fnmzgdt/e_shop/src/repositories"
+	"github.com/fnmzgdt/e_shop/src/users"
+	_ "modernc.org/sqlite"
+)
+
+func newTestDatabase(t *testing.T) *repositories.SQLiteConnection {
+	t.Helper()
+	t.Setenv("SQLITE_PATH", ":memory:")
+	db, err := repositories.SetupSQLiteConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func errorCode(err error) string {
+	var appErr *apperrors.Error
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+	return ""
+}
+
+func TestInsertUser(t *testing.T) {
+	ctx := context.Background()
+	s := users.NewUserssService(newTestDatabase(t), nil, nil, nil)
+	userId, err := s.InsertUser(ctx, &users.User{Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InsertUser(ctx, &users.User{Email: "user@example.com", Password: "hash"}); errorCode(err) != "email_taken" {
+		t.Errorf("insert of a taken email: %v", err)
+	}
+	if _, err := s.CreateServiceAccount(ctx, &users.ServiceAccount{Email: "user@example.com"}); errorCode(err) != "email_taken" {
+		t.Errorf("service account with a taken email: %v", err)
+	}
+	claims, err := s.GetClaimsFromEmail(ctx, &users.UserLogin{Email: "user@example.com"})
+	if err != nil || claims.UserId != userId || len(claims.Roles) != 0 {
+		t.Errorf("claims %+v: %v", claims, err)
+	}
+	if password, err := s.GetPasswordFromEmail(ctx, &users.UserLogin{Email: "user@example.com"}); err != nil || password != "hash" {
+		t.Errorf("password %q: %v", password, err)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	ctx := context.Background()
+	s := users.NewUserssService(newTestDatabase(t), nil, nil, nil)
+	accountId, err := s.CreateServiceAccount(ctx, &users.ServiceAccount{Email: "robot@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := s.InsertUser(ctx, &users.User{Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{accountId: true, userId: false, "999": false} {
+		if serviceAccount, err := s.IsServiceAccount(ctx, id); err != nil || serviceAccount != want {
+			t.Errorf("user %s is a service account: %v %v", id, serviceAccount, err)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	s := users.NewUserssService(db, nil, nil, nil)
+	auth := middleware.NewMiddlewareService(nil, db)
+	ownerId, err := s.CreateServiceAccount(ctx, &users.ServiceAccount{Email: "robot@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := s.CreateAPIKey(ctx, &users.APIKey{UserId: ownerId, Name: "ci", Permissions: []string{"items:write"}, AllowedIPs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := auth.AuthenticateAPIKey(ctx, created.Key, "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.UserId != ownerId || principal.APIKeyId != created.Id || len(principal.Scopes) != 1 || principal.Scopes[0] != "items:write" {
+		t.Errorf("principal %+v", *principal)
+	}
+	if _, err := auth.AuthenticateAPIKey(ctx, created.Key, "192.168.0.1"); !errors.Is(err, middleware.ErrInvalidAPIKey) {
+		t.Errorf("key used from a disallowed address: %v", err)
+	}
+	if _, err := auth.AuthenticateAPIKey(ctx, created.Key+"x", "10.1.2.3"); !errors.Is(err, middleware.ErrInvalidAPIKey) {
+		t.Errorf("wrong key: %v", err)
+	}
+
+	keys, err := s.GetAPIKeys(ctx, ownerId)
+	if err != nil || len(*keys) != 1 || (*keys)[0].Key != "" || (*keys)[0].LastUsedAt == 0 {
+		t.Errorf("keys %+v: %v", keys, err)
+	}
+	if n, err := s.RevokeAPIKey(ctx, created.Id, "999"); err != nil || n != 0 {
+		t.Errorf("revoke by another user revoked %d keys: %v", n, err)
+	}
+	if n, err := s.RevokeAPIKey(ctx, created.Id, ""); err != nil || n != 1 {
+		t.Errorf("revoke revoked %d keys: %v", n, err)
+	}
+	if _, err := auth.AuthenticateAPIKey(ctx, created.Key, "10.1.2.3"); !errors.Is(err, middleware.ErrInvalidAPIKey) {
+		t.Errorf("revoked key: %v", err)
+	}
+}
+
+func TestAPIKeysAndMFARoles(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("MFA_REQUIRED_ROLES", "staff")
+	db := newTestDatabase(t)
+	s := users.NewUserssService(db, nil, nil, nil)
+	auth := middleware.NewMiddlewareService(nil, db)
+
+	adminId, err := s.CreateServiceAccount(ctx, &users.ServiceAccount{Email: "admin-robot@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertRole(ctx, adminId, "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAPIKey(ctx, &users.APIKey{UserId: adminId, Name: "ci", Permissions: []string{middleware.UsersManage}}); !errors.Is(err, users.ErrAPIKeyRequiresMFA) {
+		t.Errorf("key of an owner with a role that requires MFA: %v", err)
+	}
+
+	ownerId, err := s.CreateServiceAccount(ctx, &users.ServiceAccount{Email: "robot@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertRole(ctx, ownerId, "catalog"); err != nil {
+		t.Fatal(err)
+	}
+	created, err := s.CreateAPIKey(ctx, &users.APIKey{UserId: ownerId, Name: "ci", Permissions: []string{middleware.ItemsWrite, middleware.UsersManage}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertRole(ctx, ownerId, "staff"); err != nil {
+		t.Fatal(err)
+	}
+	principal, err := auth.AuthenticateAPIKey(ctx, created.Key, "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.MFA {
+		t.Error("the principal of a key counts as logged in with two-factor authentication")
+	}
+	if !principal.HasPermission(middleware.ItemsWrite) {
+		t.Error("the key lost the permission of a role that doesn't require MFA")
+	}
+	if principal.HasPermission(middleware.UsersManage) {
+		t.Error("the key has the permission of a role that requires MFA")
+	}
+}
@@ -0,0 +1,297 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+	"github.com/fnmzgdt/e_shop/src/utils"
+	"github.com/google/uuid"
+)
+
+//Codes are generated as in RFC 6238 with the defaults every authenticator app supports: HMAC-SHA1, 6 digits and a 30 second period.
+const (
+	totpPeriod       = 30
+	totpDigits       = 6
+	totpSkew         = 1
+	recoveryCodes    = 10
+	enrollmentTTL    = 10 * time.Minute
+	mfaChallengeTTL  = 5 * time.Minute
+	mfaMaxAttempts   = 5
+	usedTOTPStepsTTL = (2*totpSkew + 1) * totpPeriod * time.Second
+)
+
+var totpModulus = uint32(math.Pow10(totpDigits))
+
+var (
+	ErrInvalidMFACode       = apperrors.Validation("invalid_mfa_code", "invalid two-factor authentication code")
+	ErrInvalidMFAChallenge  = apperrors.Unauthorized("invalid_mfa_challenge", "invalid or expired two-factor authentication challenge")
+	ErrTOTPAlreadyEnabled   = apperrors.Conflict("totp_already_enabled", "two-factor authentication is already enabled")
+	ErrTOTPEnrollmentAbsent = apperrors.Validation("totp_enrollment_absent", "no two-factor authentication enrollment in progress")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//Dynamic truncation as in RFC 4226 section 5.3.
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+func matchTOTP(encodedSecret string, code string, now time.Time) (int64, bool) {
+	secret, err := base32NoPadding.DecodeString(encodedSecret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+func provisioningURI(email string, secret string) string {
+	issuer := utils.GetEnv("TOTP_ISSUER", "e_shop")
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func newRecoveryCode() (string, error) {
+	random := make([]byte, 5)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32NoPadding.EncodeToString(random))
+	return code[:4] + "-" + code[4:], nil
+}
+
+//Recovery codes are random enough that a plain SHA-256 hash protects them; it also lets them be looked up directly.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func totpEnrollmentKey(userId string) string {
+	return "totp_enrollments:" + userId
+}
+
+func usedTOTPStepKey(userId string, step int64) string {
+	return "totp_used:" + userId + ":" + strconv.FormatInt(step, 10)
+}
+
+func mfaChallengeKey(token string) string {
+	return "mfa_challenges:" + token
+}
+
+func mfaAttemptsKey(token string) string {
+	return "mfa_attempts:" + token
+}
+
+func (s *service) getTOTPSecret(ctx context.Context, userId string) (string, error) {
+	return s.rdbms.GetTOTPSecret(ctx, userId)
+}
+
+func (s *service) HasTOTP(ctx context.Context, userId string) (bool, error) {
+	secret, err := s.getTOTPSecret(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	return secret != "", nil
+}
+
+//The new secret only protects the account once ConfirmTOTPEnrollment proves the user's app generates its codes.
+func (s *service) BeginTOTPEnrollment(ctx context.Context, userId string, email string) (*TOTPEnrollment, error) {
+	hasTOTP, err := s.HasTOTP(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if hasTOTP {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redis.SetKey(ctx, totpEnrollmentKey(userId), secret, enrollmentTTL); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{Secret: secret, ProvisioningURI: provisioningURI(email, secret)}, nil
+}
+
+//The recovery codes are stored hashed and can't be shown again.
+func (s *service) ConfirmTOTPEnrollment(ctx context.Context, userId string, code string) ([]string, error) {
+	secret, err := s.redis.GetKey(ctx, totpEnrollmentKey(userId))
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return nil, ErrTOTPEnrollmentAbsent
+		}
+		return nil, err
+	}
+	if err := s.checkTOTP(ctx, userId, secret, code); err != nil {
+		return nil, err
+	}
+	if err := s.rdbms.SetTOTPSecret(ctx, userId, secret); err != nil {
+		return nil, err
+	}
+	if _, err := s.redis.DeleteKeys(ctx, totpEnrollmentKey(userId)); err != nil {
+		return nil, err
+	}
+	return s.replaceRecoveryCodes(ctx, userId)
+}
+
+func (s *service) replaceRecoveryCodes(ctx context.Context, userId string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	hashes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	if err := s.rdbms.ReplaceRecoveryCodes(ctx, userId, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+//A current code is needed so a stolen session alone can't turn two-factor authentication off.
+func (s *service) DisableTOTP(ctx context.Context, userId string, code string) error {
+	secret, err := s.getTOTPSecret(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return nil
+	}
+	if err := s.checkTOTP(ctx, userId, secret, code); err != nil {
+		return err
+	}
+	if err := s.rdbms.SetTOTPSecret(ctx, userId, ""); err != nil {
+		return err
+	}
+	return s.rdbms.ReplaceRecoveryCodes(ctx, userId, nil)
+}
+
+//The same code is never accepted twice.
+func (s *service) checkTOTP(ctx context.Context, userId string, secret string, code string) error {
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	firstUse, err := s.redis.SetKeyNX(ctx, usedTOTPStepKey(userId, step), 1, usedTOTPStepsTTL)
+	if err != nil {
+		return err
+	}
+	if !firstUse {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (s *service) useRecoveryCode(ctx context.Context, userId string, code string) error {
+	used, err := s.rdbms.UseRecoveryCode(ctx, userId, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (s *service) CreateMFAChallenge(ctx context.Context, userId string) (string, error) {
+	token := uuid.New().String()
+	if err := s.redis.SetKey(ctx, mfaChallengeKey(token), userId, mfaChallengeTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *service) GetMFAChallengeUser(ctx context.Context, token string) (string, error) {
+	userId, err := s.redis.GetKey(ctx, mfaChallengeKey(token))
+	if err != nil {
+		if errors.Is(err, apperrors.ErrNotFound) {
+			return "", ErrInvalidMFAChallenge
+		}
+		return "", err
+	}
+	return userId, nil
+}
+
+//A challenge can be used only once and only for a few attempts.
+func (s *service) VerifyMFAChallenge(ctx context.Context, login *MFALogin) (string, error) {
+	userId, err := s.GetMFAChallengeUser(ctx, login.ChallengeToken)
+	if err != nil {
+		return "", err
+	}
+	attempts, err := s.redis.AddToSlidingWindow(ctx, mfaAttemptsKey(login.ChallengeToken), time.Now(), mfaChallengeTTL)
+	if err != nil {
+		return "", err
+	}
+	if int(attempts) > mfaMaxAttempts {
+		if _, err := s.redis.DeleteKeys(ctx, mfaChallengeKey(login.ChallengeToken)); err != nil {
+			return "", err
+		}
+		return "", ErrInvalidMFAChallenge
+	}
+	if strings.TrimSpace(login.RecoveryCode) != "" {
+		err = s.useRecoveryCode(ctx, userId, login.RecoveryCode)
+	} else {
+		var secret string
+		secret, err = s.getTOTPSecret(ctx, userId)
+		if err != nil {
+			return "", err
+		}
+		err = s.checkTOTP(ctx, userId, secret, login.Code)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.redis.DeleteKeys(ctx, mfaChallengeKey(login.ChallengeToken), mfaAttemptsKey(login.ChallengeToken)); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
@@ -0,0 +1,43 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+//The test vectors of RFC 6238 appendix B for SHA-1 have 8 digits; the codes here are their last 6.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		want := test.code[len(test.code)-totpDigits:]
+		if got := totpCode(secret, test.time/totpPeriod); got != want {
+			t.Errorf("code at %d: got %s, want %s", test.time, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	for _, code := range []string{"050471", "081804", " 050471 "} {
+		if _, ok := matchTOTP(secret, code, now); !ok {
+			t.Errorf("code %q was refused", code)
+		}
+	}
+	for _, code := range []string{"050472", "", "14050471"} {
+		if _, ok := matchTOTP(secret, code, now); ok {
+			t.Errorf("code %q was accepted", code)
+		}
+	}
+}
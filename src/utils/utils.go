@@ -1,6 +1,14 @@
 package utils
 
-import "os"
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 //The GetEnv function gets the value of the environment variable stored under the first argument key-name; if not defined it's assigned a default value (the second function argument).
 func GetEnv(key, defaultValue string) string {
@@ -10,3 +18,65 @@ func GetEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+//Values that don't parse are reported and replaced by the default.
+func GetEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Println(fmt.Errorf("%s: %w", key, err))
+		return defaultValue
+	}
+	return number
+}
+
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Println(fmt.Errorf("%s: %w", key, err))
+		return defaultValue
+	}
+	return duration
+}
+
+func GetEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	boolean, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Println(fmt.Errorf("%s: %w", key, err))
+		return defaultValue
+	}
+	return boolean
+}
+
+func GetEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,238 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fnmzgdt/e_shop/src/apperrors"
+)
+
+//Rules are declared per field and checked in order; the first broken rule of a field is reported and the field's remaining rules are skipped.
+//A value that is empty (0 or blank) and not Required is absent, so its other rules are skipped too.
+//
+//	v := validation.New()
+//	v.Int("price", item.Price).Required().Min(1)
+//	v.String("description", item.Description).Required().MaxLength(2000)
+//	return v.Err()
+//
+//Every violation has a code and the params of the rule, e.g. {"max": 2000}, so clients can translate the message.
+
+//The Messages are the English messages of the codes; {field} and the names of the params are replaced.
+var Messages = map[string]string{
+	"required":      "{field} can't be empty.",
+	"min":           "{field} must be at least {min}.",
+	"max":           "{field} must be at most {max}.",
+	"min_length":    "{field} must be at least {min} characters long.",
+	"max_length":    "{field} must be at most {max} characters long.",
+	"pattern":       "{field} has an invalid format.",
+	"invalid_email": "{field} must be a valid email.",
+	"one_of":        "{field} must be one of {values}.",
+	"not_found":     "{field} refers to a record that doesn't exist.",
+	"future":        "{field} must be in the future.",
+}
+
+var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
+
+type Validator struct {
+	violations apperrors.Violations
+	err        error
+}
+
+func New() *Validator {
+	return &Validator{}
+}
+
+func (v *Validator) Err() error {
+	if v.err != nil {
+		return v.err
+	}
+	return v.violations.Err()
+}
+
+func (v *Validator) Fail(field string, code string, message string, params map[string]interface{}) {
+	v.violations.AddParams(field, code, message, params)
+}
+
+func (v *Validator) Check(field string, ok bool, code string, message string) {
+	if !ok {
+		v.Fail(field, code, message, nil)
+	}
+}
+
+func (v *Validator) fail(field string, code string, params map[string]interface{}) {
+	message := strings.ReplaceAll(Messages[code], "{field}", fieldName(field))
+	for name, value := range params {
+		message = strings.ReplaceAll(message, "{"+name+"}", fmt.Sprint(value))
+	}
+	v.Fail(field, code, message, params)
+}
+
+func fieldName(field string) string {
+	if field == "" {
+		return "The value"
+	}
+	return strings.ToUpper(field[:1]) + field[1:]
+}
+
+type Lookup func() (bool, error)
+
+type rules struct {
+	v      *Validator
+	field  string
+	empty  bool
+	failed bool
+}
+
+func (r *rules) skip() bool {
+	return r.failed || r.empty
+}
+
+func (r *rules) fail(code string, params map[string]interface{}) {
+	r.failed = true
+	r.v.fail(r.field, code, params)
+}
+
+func (r *rules) required() {
+	if r.empty && !r.failed {
+		r.fail("required", nil)
+	}
+}
+
+func (r *rules) exists(lookup Lookup) {
+	if r.skip() {
+		return
+	}
+	found, err := lookup()
+	if err != nil {
+		r.failed = true
+		if r.v.err == nil {
+			r.v.err = err
+		}
+		return
+	}
+	if !found {
+		r.fail("not_found", nil)
+	}
+}
+
+type IntRules struct {
+	rules
+	value int64
+}
+
+func (v *Validator) Int(field string, value int) *IntRules {
+	return v.Int64(field, int64(value))
+}
+
+func (v *Validator) Int64(field string, value int64) *IntRules {
+	return &IntRules{rules: rules{v: v, field: field, empty: value == 0}, value: value}
+}
+
+func (r *IntRules) Required() *IntRules {
+	r.required()
+	return r
+}
+
+func (r *IntRules) Min(min int64) *IntRules {
+	if !r.skip() && r.value < min {
+		r.fail("min", map[string]interface{}{"min": min})
+	}
+	return r
+}
+
+func (r *IntRules) Max(max int64) *IntRules {
+	if !r.skip() && r.value > max {
+		r.fail("max", map[string]interface{}{"max": max})
+	}
+	return r
+}
+
+func (r *IntRules) Future() *IntRules {
+	if !r.skip() && r.value <= time.Now().Unix() {
+		r.fail("future", nil)
+	}
+	return r
+}
+
+func (r *IntRules) Exists(lookup Lookup) *IntRules {
+	r.exists(lookup)
+	return r
+}
+
+type StringRules struct {
+	rules
+	value string
+}
+
+func (v *Validator) String(field string, value string) *StringRules {
+	return &StringRules{rules: rules{v: v, field: field, empty: strings.TrimSpace(value) == ""}, value: value}
+}
+
+func (r *StringRules) Required() *StringRules {
+	r.required()
+	return r
+}
+
+func (r *StringRules) MinLength(min int) *StringRules {
+	if !r.skip() && utf8.RuneCountInString(r.value) < min {
+		r.fail("min_length", map[string]interface{}{"min": min})
+	}
+	return r
+}
+
+func (r *StringRules) MaxLength(max int) *StringRules {
+	if !r.skip() && utf8.RuneCountInString(r.value) > max {
+		r.fail("max_length", map[string]interface{}{"max": max})
+	}
+	return r
+}
+
+func (r *StringRules) Matches(pattern *regexp.Regexp) *StringRules {
+	if !r.skip() && !pattern.MatchString(r.value) {
+		r.fail("pattern", map[string]interface{}{"pattern": pattern.String()})
+	}
+	return r
+}
+
+func (r *StringRules) Email() *StringRules {
+	if !r.skip() && !emailRegex.MatchString(r.value) {
+		r.fail("invalid_email", nil)
+	}
+	return r
+}
+
+func (r *StringRules) OneOf(values ...string) *StringRules {
+	if r.skip() {
+		return r
+	}
+	for _, value := range values {
+		if r.value == value {
+			return r
+		}
+	}
+	r.fail("one_of", map[string]interface{}{"values": strings.Join(values, ", ")})
+	return r
+}
+
+func (r *StringRules) Exists(lookup Lookup) *StringRules {
+	r.exists(lookup)
+	return r
+}
+
+func IsEmail(value string) bool {
+	return emailRegex.MatchString(value)
+}
+
+func (v *Validator) Merge(prefix string, err error) {
+	if err != nil && !errors.Is(err, apperrors.ErrValidation) {
+		if v.err == nil {
+			v.err = err
+		}
+		return
+	}
+	v.violations.Merge(prefix, err)
+}